@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stormforger/testapp/internal/pki"
+)
+
+// badTLSStall is the name of the case that never answers the ClientHello.
+const badTLSStall = "stall"
+
+// badTLSStallTimeout is the time after which stalled handshakes are closed.
+var badTLSStallTimeout = time.Minute
+
+// badTLS serves deliberately broken TLS configurations for server names
+// below a domain, e.g. expired.badtls.localhost, similar to badssl.com.
+type badTLS struct {
+	domain  string
+	configs map[string]*tls.Config
+}
+
+// setupBadTLS generates the broken configurations from the CA material and
+// selects them by SNI in front of the regular certificate selection.
+func setupBadTLS(server *http.Server, domain string, certificates serverPKI, validity time.Duration) error {
+	ca, err := pki.ParseAuthority(certificates.CACertPEM, certificates.CAKeyPEM)
+	if err != nil {
+		return fmt.Errorf("loading CA: %w", err)
+	}
+
+	b := &badTLS{
+		domain:  strings.ToLower(domain),
+		configs: map[string]*tls.Config{},
+	}
+	if err := b.generate(ca, server.TLSConfig, validity); err != nil {
+		return err
+	}
+
+	server.TLSConfig.GetConfigForClient = b.getConfigForClient
+
+	var names []string
+	for c := range b.configs {
+		names = append(names, b.name(c))
+	}
+	sort.Strings(names)
+	logrus.Infof("Serving broken TLS configurations for %v and %s", names, b.name(badTLSStall))
+
+	return nil
+}
+
+func (b *badTLS) name(c string) string {
+	return c + "." + b.domain
+}
+
+func (b *badTLS) generate(ca *pki.Authority, base *tls.Config, validity time.Duration) error {
+	now := time.Now()
+	notBefore, notAfter := now.Add(-5*time.Minute), now.Add(validity)
+
+	// issue creates a certificate for the case name, served with the CA
+	issue := func(c string, template *x509.Certificate, keyType string) error {
+		key, err := pki.GenerateKey(keyType)
+		if err != nil {
+			return err
+		}
+		cert, err := ca.Issue(template, key.Public())
+		if err != nil {
+			return fmt.Errorf("issuing %s certificate: %w", c, err)
+		}
+		b.add(base, c, pki.TLSCertificate(key, cert, ca.Cert))
+		return nil
+	}
+
+	if err := issue("expired", pki.LeafTemplate([]string{b.name("expired")}, now.Add(-30*24*time.Hour), now.Add(-24*time.Hour)), pki.KeyTypeECDSA); err != nil {
+		return err
+	}
+	if err := issue("not-yet-valid", pki.LeafTemplate([]string{b.name("not-yet-valid")}, now.Add(24*time.Hour), now.Add(24*time.Hour+validity)), pki.KeyTypeECDSA); err != nil {
+		return err
+	}
+	if err := issue("wrong-host", pki.LeafTemplate([]string{"wrong-host.invalid"}, notBefore, notAfter), pki.KeyTypeECDSA); err != nil {
+		return err
+	}
+	if err := issue("tls10", pki.LeafTemplate([]string{b.name("tls10")}, notBefore, notAfter), pki.KeyTypeECDSA); err != nil {
+		return err
+	}
+	b.configs["tls10"].MinVersion = tls.VersionTLS10
+	b.configs["tls10"].MaxVersion = tls.VersionTLS10
+	b.configs["tls10"].CipherSuites = nil
+	// net/http rejects HTTP/2 with TLS 1.0 as inadequate security
+	b.configs["tls10"].NextProtos = []string{"http/1.1"}
+
+	weakKey, err := pki.GenerateRSAKey(1024)
+	if err != nil {
+		return err
+	}
+	weakCert, err := ca.Issue(pki.LeafTemplate([]string{b.name("rsa1024")}, notBefore, notAfter), weakKey.Public())
+	if err != nil {
+		return fmt.Errorf("issuing rsa1024 certificate: %w", err)
+	}
+	b.add(base, "rsa1024", pki.TLSCertificate(weakKey, weakCert, ca.Cert))
+
+	selfSignedKey, err := pki.GenerateKey(pki.KeyTypeECDSA)
+	if err != nil {
+		return err
+	}
+	selfSignedCert, err := pki.SelfSign(pki.LeafTemplate([]string{b.name("self-signed")}, notBefore, notAfter), selfSignedKey)
+	if err != nil {
+		return fmt.Errorf("signing self-signed certificate: %w", err)
+	}
+	b.add(base, "self-signed", pki.TLSCertificate(selfSignedKey, selfSignedCert))
+
+	// the intermediate is not sent, so clients cannot build a chain to the CA
+	intermediate, err := ca.IssueIntermediate("StormForger Testapp Incomplete Chain CA", pki.KeyTypeECDSA, validity)
+	if err != nil {
+		return fmt.Errorf("issuing intermediate CA: %w", err)
+	}
+	incompleteKey, err := pki.GenerateKey(pki.KeyTypeECDSA)
+	if err != nil {
+		return err
+	}
+	incompleteCert, err := intermediate.Issue(pki.LeafTemplate([]string{b.name("incomplete-chain")}, notBefore, notAfter), incompleteKey.Public())
+	if err != nil {
+		return fmt.Errorf("issuing incomplete-chain certificate: %w", err)
+	}
+	b.add(base, "incomplete-chain", pki.TLSCertificate(incompleteKey, incompleteCert))
+
+	return nil
+}
+
+// add serves cert for the case c, based on the regular server configuration.
+func (b *badTLS) add(base *tls.Config, c string, cert tls.Certificate) {
+	config := base.Clone()
+	config.GetCertificate = nil
+	config.GetConfigForClient = nil
+	config.Certificates = []tls.Certificate{cert}
+	b.configs[c] = config
+}
+
+func (b *badTLS) getConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	c := strings.TrimSuffix(name, "."+b.domain)
+	if c == name {
+		return nil, nil
+	}
+
+	if c == badTLSStall {
+		// keep the connection open without answering until the client
+		// gives up or badTLSStallTimeout passed
+		hello.Conn.SetDeadline(time.Now().Add(badTLSStallTimeout))
+		io.Copy(io.Discard, hello.Conn)
+		return nil, errors.New("stalled handshake")
+	}
+
+	return b.configs[c], nil
+}
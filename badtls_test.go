@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stormforger/testapp/internal/pki"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBadTLS(t *testing.T) {
+	badTLSStallTimeout = 100 * time.Millisecond
+
+	ca, err := pki.NewAuthority("Test CA", pki.KeyTypeECDSA, time.Hour)
+	require.Nil(t, err)
+	caKeyPEM, err := pki.EncodePrivateKey(ca.Key)
+	require.Nil(t, err)
+
+	srv := &http.Server{
+		Handler:   http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		TLSConfig: &tls.Config{NextProtos: []string{"h2", "http/1.1"}},
+	}
+	require.Nil(t, setupBadTLS(srv, "badtls.test", serverPKI{CACertPEM: pki.EncodeCertificates(ca.Cert), CAKeyPEM: caKeyPEM}, time.Hour))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	go srv.Serve(tls.NewListener(ln, srv.TLSConfig))
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	dial := func(c string, config *tls.Config) (tls.ConnectionState, error) {
+		config.ServerName = c + ".badtls.test"
+		config.RootCAs = roots
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", ln.Addr().String(), config)
+		if err != nil {
+			return tls.ConnectionState{}, err
+		}
+		defer conn.Close()
+		return conn.ConnectionState(), nil
+	}
+
+	invalidReason := func(reason x509.InvalidReason) func(t *testing.T, err error) {
+		return func(t *testing.T, err error) {
+			var invalid x509.CertificateInvalidError
+			require.True(t, errors.As(err, &invalid), "%v", err)
+			assert.Equal(t, reason, invalid.Reason)
+		}
+	}
+	unknownAuthority := func(t *testing.T, err error) {
+		assert.True(t, errors.As(err, &x509.UnknownAuthorityError{}), "%v", err)
+	}
+
+	for c, check := range map[string]func(t *testing.T, err error){
+		"expired":          invalidReason(x509.Expired),
+		"not-yet-valid":    invalidReason(x509.Expired),
+		"self-signed":      unknownAuthority,
+		"incomplete-chain": unknownAuthority,
+		"wrong-host": func(t *testing.T, err error) {
+			assert.True(t, errors.As(err, &x509.HostnameError{}), "%v", err)
+		},
+	} {
+		t.Run(c, func(t *testing.T) {
+			_, err := dial(c, &tls.Config{})
+			check(t, err)
+		})
+	}
+
+	t.Run("rsa1024", func(t *testing.T) {
+		state, err := dial("rsa1024", &tls.Config{})
+		require.Nil(t, err)
+		assert.Equal(t, 1024, state.PeerCertificates[0].PublicKey.(*rsa.PublicKey).N.BitLen())
+	})
+
+	t.Run("tls10", func(t *testing.T) {
+		state, err := dial("tls10", &tls.Config{MinVersion: tls.VersionTLS10, NextProtos: []string{"h2", "http/1.1"}})
+		require.Nil(t, err)
+		assert.Equal(t, uint16(tls.VersionTLS10), state.Version)
+		assert.Equal(t, "http/1.1", state.NegotiatedProtocol)
+
+		_, err = dial("tls10", &tls.Config{MinVersion: tls.VersionTLS12})
+		assert.NotNil(t, err)
+	})
+
+	t.Run("stall", func(t *testing.T) {
+		start := time.Now()
+		_, err := dial("stall", &tls.Config{})
+		assert.NotNil(t, err)
+		assert.Less(t, time.Since(start), 5*time.Second)
+	})
+}
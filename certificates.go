@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stormforger/testapp/internal/pki"
+	"github.com/stormforger/testapp/internal/tlsutil"
+)
+
+// serverPKI is the certificate material used by the HTTPS server and the
+// X.509/EST endpoints.
+type serverPKI struct {
+	// Certificate is served by the HTTPS server.
+	Certificate tls.Certificate
+	// CACertPEM and CAKeyPEM are used to issue certificates via EST.
+	CACertPEM []byte
+	CAKeyPEM  []byte
+}
+
+func loadServerPKI(config testAppConfig) (serverPKI, error) {
+	switch config.TLSAutogenerate {
+	case "true":
+		return generateServerPKI(config)
+	case "auto":
+		if !fileExists(config.ServerCertificateFile) || !fileExists(config.ServerPrivateKeyFile) {
+			logrus.Warnf("TLS certificate %s or key %s not found, generating ephemeral certificates", config.ServerCertificateFile, config.ServerPrivateKeyFile)
+			return generateServerPKI(config)
+		}
+	}
+
+	return readServerPKI(config.ServerCertificateFile, config.ServerPrivateKeyFile)
+}
+
+// readServerPKI loads the server certificate and key from disk. The server
+// certificate also acts as CA for the EST endpoints.
+func readServerPKI(certFile, keyFile string) (serverPKI, error) {
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return serverPKI{}, err
+	}
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return serverPKI{}, err
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return serverPKI{}, err
+	}
+
+	return serverPKI{
+		Certificate: cert,
+		CACertPEM:   certPEM,
+		CAKeyPEM:    keyPEM,
+	}, nil
+}
+
+// generateServerPKI creates an ephemeral CA and a server certificate issued
+// by it.
+func generateServerPKI(config testAppConfig) (serverPKI, error) {
+	ca, err := pki.NewAuthority("StormForger Testapp Ephemeral CA", config.TLSAutogenerateKeyType, config.TLSAutogenerateValidity)
+	if err != nil {
+		return serverPKI{}, fmt.Errorf("generating CA: %w", err)
+	}
+
+	key, err := pki.GenerateKey(config.TLSAutogenerateKeyType)
+	if err != nil {
+		return serverPKI{}, fmt.Errorf("generating server key: %w", err)
+	}
+
+	now := time.Now()
+	leaf, err := ca.Issue(pki.LeafTemplate(config.TLSAutogenerateSANs, now.Add(-5*time.Minute), now.Add(config.TLSAutogenerateValidity)), key.Public())
+	if err != nil {
+		return serverPKI{}, fmt.Errorf("issuing server certificate: %w", err)
+	}
+
+	caKeyPEM, err := pki.EncodePrivateKey(ca.Key)
+	if err != nil {
+		return serverPKI{}, err
+	}
+
+	p := serverPKI{
+		Certificate: pki.TLSCertificate(key, leaf, ca.Cert),
+		CACertPEM:   pki.EncodeCertificates(ca.Cert),
+		CAKeyPEM:    caKeyPEM,
+	}
+
+	if config.TLSAutogenerateOut != "" {
+		keyPEM, err := pki.EncodePrivateKey(key)
+		if err != nil {
+			return serverPKI{}, err
+		}
+
+		files := []struct {
+			name string
+			data []byte
+			perm fs.FileMode
+		}{
+			{"ca.cert.pem", p.CACertPEM, 0644},
+			{"ca.key.pem", p.CAKeyPEM, 0600},
+			{"server.cert.pem", pki.EncodeCertificates(leaf, ca.Cert), 0644},
+			{"server.key.pem", keyPEM, 0600},
+		}
+		for _, f := range files {
+			if err := ioutil.WriteFile(filepath.Join(config.TLSAutogenerateOut, f.name), f.data, f.perm); err != nil {
+				return serverPKI{}, err
+			}
+		}
+		logrus.Infof("Wrote generated certificates to %s", config.TLSAutogenerateOut)
+	}
+
+	logrus.Infof("Generated %s server certificate for %v, valid until %s", config.TLSAutogenerateKeyType, config.TLSAutogenerateSANs, leaf.NotAfter.Format(time.RFC3339))
+
+	return p, nil
+}
+
+// loadCertStore creates the store selecting the server certificate by SNI.
+// Besides the default certificate, it contains every <name>.cert.pem and
+// <name>.key.pem pair found in TLS_CERT_DIR.
+func loadCertStore(config testAppConfig, defaultCert tls.Certificate) (*tlsutil.CertStore, error) {
+	store := tlsutil.NewCertStore(defaultCert)
+	store.RejectUnknown = config.TLSUnknownSNI == "reject"
+	if err := store.Add(defaultCert); err != nil {
+		return nil, err
+	}
+
+	if config.TLSCertDir == "" {
+		return store, nil
+	}
+
+	certFiles, err := filepath.Glob(filepath.Join(config.TLSCertDir, "*.cert.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, certFile := range certFiles {
+		keyFile := strings.TrimSuffix(certFile, ".cert.pem") + ".key.pem"
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading %s: %w", certFile, err)
+		}
+		if err := store.Add(cert); err != nil {
+			return nil, fmt.Errorf("loading %s: %w", certFile, err)
+		}
+	}
+
+	logrus.Infof("Loaded %d certificates from %s, serving names %v", len(certFiles), config.TLSCertDir, store.Names())
+
+	return store, nil
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return !errors.Is(err, fs.ErrNotExist)
+}
@@ -0,0 +1,73 @@
+// Package conninfo makes the network connection of a request available to
+// HTTP handlers.
+package conninfo
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+)
+
+type connContextKey struct{}
+
+// lastID is the ID of the most recently accepted connection.
+var lastID atomic.Uint64
+
+type connState struct {
+	conn     net.Conn
+	id       uint64
+	requests atomic.Uint64
+}
+
+// ConnContext stores c in ctx, together with a new connection ID. It is
+// meant to be used as http.Server.ConnContext.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, &connState{conn: c, id: lastID.Add(1)})
+}
+
+func stateFromContext(ctx context.Context) *connState {
+	s, _ := ctx.Value(connContextKey{}).(*connState)
+	return s
+}
+
+// FromContext returns the connection stored by ConnContext, or nil.
+func FromContext(ctx context.Context) net.Conn {
+	if s := stateFromContext(ctx); s != nil {
+		return s.conn
+	}
+	return nil
+}
+
+// ID returns the ID of the connection stored by ConnContext, or 0. IDs are
+// unique across all servers of the process.
+func ID(ctx context.Context) uint64 {
+	if s := stateFromContext(ctx); s != nil {
+		return s.id
+	}
+	return 0
+}
+
+// NextRequest counts a request on the connection stored by ConnContext and
+// returns its sequence number, starting at 1. It returns 0 without connection.
+func NextRequest(ctx context.Context) uint64 {
+	if s := stateFromContext(ctx); s != nil {
+		return s.requests.Add(1)
+	}
+	return 0
+}
+
+// Walk calls fn for c and every connection wrapped by it, following
+// NetConn() methods like the one of *tls.Conn, until fn returns true.
+func Walk(c net.Conn, fn func(net.Conn) bool) {
+	for c != nil {
+		if fn(c) {
+			return
+		}
+
+		w, ok := c.(interface{ NetConn() net.Conn })
+		if !ok {
+			return
+		}
+		c = w.NetConn()
+	}
+}
@@ -0,0 +1,261 @@
+// Package metrics implements counters and histograms exposed in the
+// Prometheus text format.
+//
+// It covers the few metric types testapp needs without depending on
+// prometheus/client_golang, whose current releases require a newer Go version
+// than this module and pull in a considerable dependency tree.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Registry holds metrics in order of registration.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+// Default is the registry exposed by Handler.
+var Default = &Registry{}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// WriteText writes all metrics in the Prometheus text format.
+func (r *Registry) WriteText(w io.Writer) {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// Handler responds with the metrics of the Default registry.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	Default.WriteText(w)
+}
+
+// vec keeps one value per combination of label values.
+type vec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string][]string
+}
+
+func newVec(name, help string, labels []string) vec {
+	return vec{name: name, help: help, labels: labels, values: map[string][]string{}}
+}
+
+// key returns the map key of labelValues, remembering the values for output.
+// Must be called with mu held.
+func (v *vec) key(labelValues []string) string {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.name, len(v.labels), len(labelValues)))
+	}
+
+	k := strings.Join(labelValues, "\xff")
+	if _, exists := v.values[k]; !exists {
+		v.values[k] = append([]string(nil), labelValues...)
+	}
+	return k
+}
+
+// sortedKeys must be called with mu held.
+func (v *vec) sortedKeys() []string {
+	keys := make([]string, 0, len(v.values))
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (v *vec) header(w io.Writer, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, typ)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelString formats the labels of key with additional label pairs.
+func (v *vec) labelString(key string, extra ...string) string {
+	var pairs []string
+	for i, value := range v.values[key] {
+		pairs = append(pairs, v.labels[i]+`="`+labelEscaper.Replace(value)+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+labelEscaper.Replace(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// CounterVec is a counter partitioned by labels.
+type CounterVec struct {
+	vec
+	counts map[string]float64
+}
+
+// NewCounterVec creates a counter and registers it with the Default registry.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{vec: newVec(name, help, labels), counts: map[string]float64{}}
+	Default.register(c)
+	return c
+}
+
+// Inc increments the counter for labelValues by one.
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increments the counter for labelValues by delta.
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[c.key(labelValues)] += delta
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.header(w, "counter")
+	for _, k := range c.sortedKeys() {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelString(k), formatFloat(c.counts[k]))
+	}
+}
+
+// GaugeVec is a gauge partitioned by labels.
+type GaugeVec struct {
+	vec
+	values map[string]float64
+}
+
+// NewGaugeVec creates a gauge and registers it with the Default registry.
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{vec: newVec(name, help, labels), values: map[string]float64{}}
+	Default.register(g)
+	return g
+}
+
+// Inc increments the gauge for labelValues by one.
+func (g *GaugeVec) Inc(labelValues ...string) {
+	g.Add(1, labelValues...)
+}
+
+// Dec decrements the gauge for labelValues by one.
+func (g *GaugeVec) Dec(labelValues ...string) {
+	g.Add(-1, labelValues...)
+}
+
+// Add changes the gauge for labelValues by delta.
+func (g *GaugeVec) Add(delta float64, labelValues ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.values[g.key(labelValues)] += delta
+}
+
+func (g *GaugeVec) write(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.header(w, "gauge")
+	for _, k := range g.sortedKeys() {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, g.labelString(k), formatFloat(g.values[k]))
+	}
+}
+
+// HistogramVec is a histogram partitioned by labels.
+type HistogramVec struct {
+	vec
+	buckets []float64
+	series  map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogramVec creates a histogram with the given upper bucket bounds and
+// registers it with the Default registry.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		vec:     newVec(name, help, labels),
+		buckets: append([]float64(nil), buckets...),
+		series:  map[string]*histogram{},
+	}
+	sort.Float64s(h.buckets)
+	Default.register(h)
+	return h
+}
+
+// Observe adds value to the histogram for labelValues.
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	k := h.key(labelValues)
+	s, exists := h.series[k]
+	if !exists {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[k] = s
+	}
+
+	for i, bound := range h.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.header(w, "histogram")
+	for _, k := range h.sortedKeys() {
+		s := h.series[k]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(k, "le", formatFloat(bound)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(k, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelString(k), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelString(k), s.count)
+	}
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	if v == math.Trunc(v) && math.Abs(v) < 1e15 {
+		return strconv.FormatFloat(v, 'f', 0, 64)
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,35 @@
+package metrics_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stormforger/testapp/internal/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteText(t *testing.T) {
+	requests := metrics.NewCounterVec("test_requests_total", "Requests.", "method")
+	requests.Inc("GET")
+	requests.Add(2, `"quoted"`)
+
+	durations := metrics.NewHistogramVec("test_duration_seconds", "Durations.", []float64{1, 0.1})
+	durations.Observe(0.05)
+	durations.Observe(0.5)
+
+	var b bytes.Buffer
+	metrics.Default.WriteText(&b)
+
+	assert.Equal(t, `# HELP test_requests_total Requests.
+# TYPE test_requests_total counter
+test_requests_total{method="\"quoted\""} 2
+test_requests_total{method="GET"} 1
+# HELP test_duration_seconds Durations.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{le="0.1"} 1
+test_duration_seconds_bucket{le="1"} 2
+test_duration_seconds_bucket{le="+Inf"} 2
+test_duration_seconds_sum 0.55
+test_duration_seconds_count 2
+`, b.String())
+}
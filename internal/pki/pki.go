@@ -0,0 +1,232 @@
+// Package pki generates keys and certificates for testing purposes.
+//
+// Nothing generated by this package is meant to be used outside of a test
+// setup.
+package pki
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+)
+
+// Supported key types for GenerateKey.
+const (
+	KeyTypeRSA     = "rsa"
+	KeyTypeECDSA   = "ecdsa"
+	KeyTypeEd25519 = "ed25519"
+)
+
+// GenerateKey creates a new private key of the given type. RSA keys are 2048
+// bits, ECDSA keys use the P-256 curve.
+func GenerateKey(keyType string) (crypto.Signer, error) {
+	switch strings.ToLower(keyType) {
+	case KeyTypeRSA:
+		return GenerateRSAKey(2048)
+	case KeyTypeECDSA:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", keyType)
+	}
+}
+
+// GenerateRSAKey creates a new RSA private key with the given size in bits.
+func GenerateRSAKey(bits int) (crypto.Signer, error) {
+	return rsa.GenerateKey(rand.Reader, bits)
+}
+
+// KeyType returns the key type of a public key, or "unknown".
+func KeyType(pub crypto.PublicKey) string {
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		return KeyTypeRSA
+	case *ecdsa.PublicKey:
+		return KeyTypeECDSA
+	case ed25519.PublicKey:
+		return KeyTypeEd25519
+	default:
+		return "unknown"
+	}
+}
+
+// Authority is a certificate authority that can issue certificates.
+type Authority struct {
+	Cert *x509.Certificate
+	Key  crypto.Signer
+}
+
+// NewAuthority creates a self-signed CA certificate valid for the given
+// duration, starting now.
+func NewAuthority(commonName, keyType string, validity time.Duration) (*Authority, error) {
+	key, err := GenerateKey(keyType)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	cert, err := SelfSign(CATemplate(commonName, now.Add(-5*time.Minute), now.Add(validity)), key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Authority{Cert: cert, Key: key}, nil
+}
+
+// ParseAuthority loads a CA from its PEM encoded certificate and private key.
+func ParseAuthority(certPEM, keyPEM []byte) (*Authority, error) {
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", pair.PrivateKey)
+	}
+
+	return &Authority{Cert: cert, Key: key}, nil
+}
+
+// Issue signs template for the public key pub.
+func (a *Authority) Issue(template *x509.Certificate, pub crypto.PublicKey) (*x509.Certificate, error) {
+	return sign(template, a.Cert, pub, a.Key)
+}
+
+// IssueIntermediate creates a new intermediate CA signed by a.
+func (a *Authority) IssueIntermediate(commonName, keyType string, validity time.Duration) (*Authority, error) {
+	key, err := GenerateKey(keyType)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := CATemplate(commonName, now.Add(-5*time.Minute), now.Add(validity))
+	template.MaxPathLen = 0
+	template.MaxPathLenZero = true
+
+	cert, err := a.Issue(template, key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	return &Authority{Cert: cert, Key: key}, nil
+}
+
+// SelfSign signs template with key itself.
+func SelfSign(template *x509.Certificate, key crypto.Signer) (*x509.Certificate, error) {
+	return sign(template, template, key.Public(), key)
+}
+
+func sign(template, parent *x509.Certificate, pub crypto.PublicKey, signer crypto.Signer) (*x509.Certificate, error) {
+	raw, err := x509.CreateCertificate(rand.Reader, template, parent, pub, signer)
+	if err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificate(raw)
+}
+
+// CATemplate returns a certificate template for a certificate authority.
+func CATemplate(commonName string, notBefore, notAfter time.Time) *x509.Certificate {
+	return &x509.Certificate{
+		SerialNumber:          serialNumber(),
+		Subject:               pkix.Name{CommonName: commonName, Organization: []string{"StormForger Testapp"}},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+}
+
+// LeafTemplate returns a TLS server certificate template. Each host is
+// added as IP address SAN if it parses as an IP, otherwise as DNS name SAN.
+// The first host is used as common name.
+func LeafTemplate(hosts []string, notBefore, notAfter time.Time) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber(),
+		Subject:               pkix.Name{Organization: []string{"StormForger Testapp"}},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	if len(hosts) > 0 {
+		template.Subject.CommonName = hosts[0]
+	}
+
+	return template
+}
+
+// TLSCertificate builds a tls.Certificate from a certificate chain (leaf
+// first) and the private key of the leaf.
+func TLSCertificate(key crypto.Signer, chain ...*x509.Certificate) tls.Certificate {
+	cert := tls.Certificate{PrivateKey: key}
+	for _, c := range chain {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+	if len(chain) > 0 {
+		cert.Leaf = chain[0]
+	}
+
+	return cert
+}
+
+// EncodeCertificates returns the PEM encoding of certs.
+func EncodeCertificates(certs ...*x509.Certificate) []byte {
+	var data []byte
+	for _, c := range certs {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+	}
+
+	return data
+}
+
+// EncodePrivateKey returns the PKCS#8 PEM encoding of key.
+func EncodePrivateKey(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+var serialNumberLimit = new(big.Int).Lsh(big.NewInt(1), 128)
+
+func serialNumber() *big.Int {
+	n, err := rand.Int(rand.Reader, serialNumberLimit)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
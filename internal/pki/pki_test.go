@@ -0,0 +1,35 @@
+package pki_test
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/stormforger/testapp/internal/pki"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthorityIssuesVerifiableLeaf(t *testing.T) {
+	for _, keyType := range []string{pki.KeyTypeRSA, pki.KeyTypeECDSA, pki.KeyTypeEd25519} {
+		t.Run(keyType, func(t *testing.T) {
+			ca, err := pki.NewAuthority("test CA", keyType, time.Hour)
+			require.Nil(t, err)
+
+			key, err := pki.GenerateKey(keyType)
+			require.Nil(t, err)
+
+			now := time.Now()
+			leaf, err := ca.Issue(pki.LeafTemplate([]string{"localhost", "127.0.0.1"}, now, now.Add(time.Hour)), key.Public())
+			require.Nil(t, err)
+
+			assert.Equal(t, []string{"localhost"}, leaf.DNSNames)
+			assert.Len(t, leaf.IPAddresses, 1)
+
+			roots := x509.NewCertPool()
+			roots.AddCert(ca.Cert)
+			_, err = leaf.Verify(x509.VerifyOptions{DNSName: "localhost", Roots: roots})
+			assert.Nil(t, err)
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var (
+	v1Prefix    = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// maxV1HeaderSize is the maximum length of a v1 header including CRLF.
+const maxV1HeaderSize = 107
+
+// TLV types defined by the PROXY protocol specification and AWS.
+var tlvNames = map[uint8]string{
+	0x01: "ALPN",
+	0x02: "AUTHORITY",
+	0x03: "CRC32C",
+	0x04: "NOOP",
+	0x05: "UNIQUE_ID",
+	0x20: "SSL",
+	0x30: "NETNS",
+	0xEA: "AWS",
+}
+
+// Header is a parsed PROXY protocol header.
+type Header struct {
+	Version int
+	// Local is set for v2 LOCAL commands, e.g. health checks of the proxy,
+	// which carry no client address.
+	Local       bool
+	Source      net.Addr
+	Destination net.Addr
+	TLVs        []TLV
+}
+
+// TLV is a type-length-value field of a v2 header.
+type TLV struct {
+	Type  uint8
+	Value []byte
+}
+
+// Name returns the name of the TLV type, or its hex value if unknown.
+func (t TLV) Name() string {
+	if name, exists := tlvNames[t.Type]; exists {
+		return name
+	}
+	return fmt.Sprintf("0x%02x", t.Type)
+}
+
+// hasHeader reports whether r starts with a v1 or v2 header, without
+// consuming data.
+func hasHeader(r *bufio.Reader) (bool, error) {
+	b, err := r.Peek(len(v1Prefix))
+	if err != nil {
+		return false, err
+	}
+	if bytes.Equal(b, v1Prefix) {
+		return true, nil
+	}
+	if !bytes.Equal(b, v2Signature[:len(v1Prefix)]) {
+		return false, nil
+	}
+
+	b, err = r.Peek(len(v2Signature))
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(b, v2Signature), nil
+}
+
+// readHeader reads a v1 or v2 header from r.
+func readHeader(r *bufio.Reader) (*Header, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if b[0] == 'P' {
+		return readV1Header(r)
+	}
+	return readV2Header(r)
+}
+
+func readV1Header(r *bufio.Reader) (*Header, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= maxV1HeaderSize {
+			return nil, errors.New("proxyproto: v1 header too long")
+		}
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+	}
+
+	fields := strings.Fields(string(line))
+	h := &Header{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return h, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("proxyproto: invalid v1 header %q", strings.TrimSpace(string(line)))
+	}
+
+	src, err := v1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+	dst, err := v1Addr(fields[3], fields[5])
+	if err != nil {
+		return nil, err
+	}
+	h.Source, h.Destination = src, dst
+
+	return h, nil
+}
+
+func v1Addr(ip, port string) (*net.TCPAddr, error) {
+	addr := &net.TCPAddr{IP: net.ParseIP(ip)}
+	if addr.IP == nil {
+		return nil, fmt.Errorf("proxyproto: invalid address %q", ip)
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("proxyproto: invalid port %q", port)
+	}
+	addr.Port = int(p)
+
+	return addr, nil
+}
+
+func readV2Header(r *bufio.Reader) (*Header, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+
+	verCmd, family := fixed[12], fixed[13]
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("proxyproto: unsupported version %d", verCmd>>4)
+	}
+
+	data := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	h := &Header{Version: 2}
+	switch verCmd & 0x0f {
+	case 0x0:
+		h.Local = true
+		return h, nil
+	case 0x1:
+	default:
+		return nil, fmt.Errorf("proxyproto: unsupported command 0x%x", verCmd&0x0f)
+	}
+
+	var addrLen, ipLen int
+	switch family >> 4 {
+	case 0x1: // AF_INET
+		addrLen, ipLen = 12, 4
+	case 0x2: // AF_INET6
+		addrLen, ipLen = 36, 16
+	case 0x3: // AF_UNIX
+		addrLen = 216
+	}
+	if len(data) < addrLen {
+		return nil, errors.New("proxyproto: truncated v2 addresses")
+	}
+	if ipLen > 0 {
+		h.Source, h.Destination = v2Addrs(family, data, ipLen)
+	}
+
+	tlvs := data[addrLen:]
+	for len(tlvs) > 0 {
+		if len(tlvs) < 3 {
+			return nil, errors.New("proxyproto: truncated TLV")
+		}
+		length := int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < 3+length {
+			return nil, errors.New("proxyproto: truncated TLV")
+		}
+		h.TLVs = append(h.TLVs, TLV{Type: tlvs[0], Value: tlvs[3 : 3+length]})
+		tlvs = tlvs[3+length:]
+	}
+
+	return h, nil
+}
+
+// v2Addrs decodes the source and destination address of the given IP size.
+func v2Addrs(family byte, data []byte, ipLen int) (net.Addr, net.Addr) {
+	srcIP := net.IP(append([]byte(nil), data[:ipLen]...))
+	dstIP := net.IP(append([]byte(nil), data[ipLen:2*ipLen]...))
+	srcPort := int(binary.BigEndian.Uint16(data[2*ipLen:]))
+	dstPort := int(binary.BigEndian.Uint16(data[2*ipLen+2:]))
+
+	if family&0x0f == 0x2 { // DGRAM
+		return &net.UDPAddr{IP: srcIP, Port: srcPort}, &net.UDPAddr{IP: dstIP, Port: dstPort}
+	}
+	return &net.TCPAddr{IP: srcIP, Port: srcPort}, &net.TCPAddr{IP: dstIP, Port: dstPort}
+}
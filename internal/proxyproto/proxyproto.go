@@ -0,0 +1,164 @@
+// Package proxyproto implements a listener accepting connections prefixed
+// with a PROXY protocol v1 or v2 header, as sent by HAProxy or AWS NLBs.
+// See https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+package proxyproto
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/stormforger/testapp/internal/conninfo"
+)
+
+// headerTimeout limits how long reading the header may take.
+const headerTimeout = 10 * time.Second
+
+// NewListener wraps l to parse PROXY protocol headers of connections from
+// trusted addresses. Connections without header and connections from other
+// addresses are passed through unmodified.
+func NewListener(l net.Listener, trusted []*net.IPNet) net.Listener {
+	return &listener{Listener: l, trusted: trusted}
+}
+
+type listener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if !l.isTrusted(c.RemoteAddr()) {
+		return c, nil
+	}
+
+	// the header is read on first use, so a slow client does not block
+	// accepting further connections
+	return &Conn{Conn: c, r: bufio.NewReader(c)}, nil
+}
+
+func (l *listener) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	for _, n := range l.trusted {
+		if n.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn is a connection from a trusted proxy. Its addresses are the ones sent
+// in the PROXY protocol header, if any.
+type Conn struct {
+	net.Conn
+	r *bufio.Reader
+
+	once   sync.Once
+	header *Header
+	err    error
+
+	mu           sync.Mutex
+	readDeadline time.Time
+}
+
+// NetConn returns the wrapped connection.
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// readHeader reads the header once, within headerTimeout or an earlier
+// read deadline.
+func (c *Conn) readHeader() {
+	c.once.Do(func() {
+		c.mu.Lock()
+		deadline := c.readDeadline
+		c.mu.Unlock()
+
+		timeout := time.Now().Add(headerTimeout)
+		if deadline.IsZero() || deadline.After(timeout) {
+			c.Conn.SetReadDeadline(timeout)
+			defer c.Conn.SetReadDeadline(deadline)
+		}
+
+		found, err := hasHeader(c.r)
+		if err != nil || !found {
+			c.err = err
+			return
+		}
+
+		c.header, c.err = readHeader(c.r)
+	})
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+// Header returns the PROXY protocol header, or nil if none was sent.
+func (c *Conn) Header() *Header {
+	c.readHeader()
+	return c.header
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the client address sent by the proxy.
+func (c *Conn) RemoteAddr() net.Addr {
+	if h := c.Header(); h != nil && h.Source != nil {
+		return h.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the address the client connected to the proxy.
+func (c *Conn) LocalAddr() net.Addr {
+	if h := c.Header(); h != nil && h.Destination != nil {
+		return h.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+// HeaderFromConn returns the header read by a Conn wrapped by c, or nil.
+func HeaderFromConn(c net.Conn) *Header {
+	var header *Header
+	conninfo.Walk(c, func(c net.Conn) bool {
+		if pc, ok := c.(*Conn); ok {
+			header = pc.Header()
+			return true
+		}
+		return false
+	})
+	return header
+}
+
+// HeaderFromContext returns the header of the connection of a request, or
+// nil. See conninfo.ConnContext.
+func HeaderFromContext(ctx context.Context) *Header {
+	return HeaderFromConn(conninfo.FromContext(ctx))
+}
@@ -0,0 +1,89 @@
+package proxyproto_test
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stormforger/testapp/internal/proxyproto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// accept sends data to a listener trusting trusted and returns the accepted
+// connection.
+func accept(t *testing.T, trusted string, data []byte) net.Conn {
+	_, n, err := net.ParseCIDR(trusted)
+	require.Nil(t, err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	ln := proxyproto.NewListener(l, []*net.IPNet{n})
+	t.Cleanup(func() { ln.Close() })
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	require.Nil(t, err)
+	t.Cleanup(func() { client.Close() })
+	_, err = client.Write(data)
+	require.Nil(t, err)
+
+	c, err := ln.Accept()
+	require.Nil(t, err)
+	t.Cleanup(func() { c.Close() })
+
+	return c
+}
+
+func readAll(t *testing.T, c net.Conn, n int) string {
+	b := make([]byte, n)
+	_, err := io.ReadFull(c, b)
+	require.Nil(t, err)
+	return string(b)
+}
+
+func TestV1(t *testing.T) {
+	c := accept(t, "127.0.0.0/8", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET /"))
+
+	assert.Equal(t, "192.0.2.1:56324", c.RemoteAddr().String())
+	assert.Equal(t, "198.51.100.1:443", c.LocalAddr().String())
+	assert.Equal(t, "GET /", readAll(t, c, 5))
+	assert.Equal(t, 1, proxyproto.HeaderFromConn(c).Version)
+}
+
+func TestV2(t *testing.T) {
+	header := []byte("\r\n\r\n\x00\r\nQUIT\n")
+	header = append(header, 0x21, 0x11) // PROXY, TCP over IPv4
+	addrs := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb}
+	tlv := []byte{0x02, 0x00, 0x0b}
+	tlv = append(tlv, "example.com"...)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)+len(tlv)))
+	header = append(header, addrs...)
+	header = append(header, tlv...)
+
+	c := accept(t, "127.0.0.0/8", append(header, "GET /"...))
+
+	assert.Equal(t, "192.0.2.1:56324", c.RemoteAddr().String())
+	assert.Equal(t, "198.51.100.1:443", c.LocalAddr().String())
+	assert.Equal(t, "GET /", readAll(t, c, 5))
+
+	h := proxyproto.HeaderFromConn(c)
+	require.NotNil(t, h)
+	require.Len(t, h.TLVs, 1)
+	assert.Equal(t, "AUTHORITY", h.TLVs[0].Name())
+	assert.Equal(t, "example.com", string(h.TLVs[0].Value))
+}
+
+func TestWithoutHeader(t *testing.T) {
+	c := accept(t, "127.0.0.0/8", []byte("GET / HTTP/1.1\r\n"))
+	assert.Equal(t, "GET / HTTP/1.1\r\n", readAll(t, c, 16))
+	assert.Nil(t, proxyproto.HeaderFromConn(c))
+}
+
+func TestUntrustedSource(t *testing.T) {
+	data := "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+	c := accept(t, "192.0.2.0/24", []byte(data))
+
+	assert.Contains(t, c.RemoteAddr().String(), "127.0.0.1")
+	assert.Equal(t, data, readAll(t, c, len(data)))
+}
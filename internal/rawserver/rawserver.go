@@ -0,0 +1,269 @@
+// Package rawserver implements plain TCP and UDP test servers, similar to
+// the classic echo (RFC 862), discard (RFC 863) and chargen (RFC 864)
+// services.
+package rawserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stormforger/testapp/internal/metrics"
+)
+
+// TCP server modes.
+const (
+	// ModeEcho sends back everything received.
+	ModeEcho = "echo"
+	// ModeDiscard reads and drops everything received.
+	ModeDiscard = "discard"
+	// ModeChargen sends a rotating pattern of printable characters.
+	ModeChargen = "chargen"
+	// ModeHang accepts connections but never reads or writes.
+	ModeHang = "hang"
+)
+
+// DefaultHangTimeout is the default HangTimeout.
+const DefaultHangTimeout = 5 * time.Minute
+
+var (
+	connectionsTotal = metrics.NewCounterVec("testapp_raw_connections_total",
+		"Accepted connections of the raw TCP servers.", "mode")
+	activeConnections = metrics.NewGaugeVec("testapp_raw_active_connections",
+		"Open connections of the raw TCP servers.", "mode")
+	bytesReceived = metrics.NewCounterVec("testapp_raw_received_bytes_total",
+		"Bytes received by the raw TCP and UDP servers.", "protocol", "mode")
+	bytesSent = metrics.NewCounterVec("testapp_raw_sent_bytes_total",
+		"Bytes sent by the raw TCP and UDP servers.", "protocol", "mode")
+	packetsReceived = metrics.NewCounterVec("testapp_raw_received_packets_total",
+		"Packets received by the raw UDP servers.", "mode")
+)
+
+// TCPServer serves connections in one of the modes.
+type TCPServer struct {
+	Mode string
+	// HangTimeout closes connections in ModeHang after this duration, zero
+	// meaning DefaultHangTimeout. As they are never read, connections closed
+	// by the client are only noticed then.
+	HangTimeout time.Duration
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+// Serve accepts connections on ln until ctx is done. All open connections are
+// closed then.
+func (s *TCPServer) Serve(ctx context.Context, ln net.Listener) error {
+	switch s.Mode {
+	case ModeEcho, ModeDiscard, ModeChargen, ModeHang:
+	default:
+		return fmt.Errorf("unknown mode %q", s.Mode)
+	}
+
+	s.mu.Lock()
+	s.conns = map[net.Conn]struct{}{}
+	s.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for c := range s.conns {
+			c.Close()
+		}
+	}()
+
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		s.conns[c] = struct{}{}
+		s.mu.Unlock()
+
+		go s.handle(ctx, c)
+	}
+}
+
+func (s *TCPServer) handle(ctx context.Context, c net.Conn) {
+	connectionsTotal.Inc(s.Mode)
+	activeConnections.Inc(s.Mode)
+	defer func() {
+		c.Close()
+		activeConnections.Dec(s.Mode)
+
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+	}()
+
+	r := &countingReader{r: c, counted: countedBytes{counter: bytesReceived, labels: []string{"tcp", s.Mode}}}
+	w := &countingWriter{w: c, counted: countedBytes{counter: bytesSent, labels: []string{"tcp", s.Mode}}}
+	defer w.counted.flush()
+
+	var err error
+	switch s.Mode {
+	case ModeEcho:
+		_, err = io.Copy(w, r)
+		r.counted.flush()
+	case ModeDiscard:
+		_, err = io.Copy(io.Discard, r)
+		r.counted.flush()
+	case ModeChargen:
+		// input is ignored, but read to notice closed connections
+		go func() {
+			io.Copy(io.Discard, r)
+			r.counted.flush()
+		}()
+		err = chargen(w)
+	case ModeHang:
+		timeout := s.HangTimeout
+		if timeout <= 0 {
+			timeout = DefaultHangTimeout
+		}
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+		}
+	}
+
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		logrus.Debugf("raw %s connection from %s: %v", s.Mode, c.RemoteAddr(), err)
+	}
+}
+
+// chargen writes lines of 72 characters, each starting one character further
+// in the printable ASCII set, until writing fails.
+func chargen(w io.Writer) error {
+	for {
+		if _, err := w.Write(chargenPattern); err != nil {
+			return err
+		}
+	}
+}
+
+// chargenPattern holds whole cycles of the chargen lines, as many as fit
+// into 64 KiB, so they are written with few system calls.
+var chargenPattern = func() []byte {
+	const lineLength = 72
+	var printable []byte
+	for c := byte(' '); c <= '~'; c++ {
+		printable = append(printable, c)
+	}
+
+	var cycle []byte
+	for offset := range printable {
+		for i := 0; i < lineLength; i++ {
+			cycle = append(cycle, printable[(offset+i)%len(printable)])
+		}
+		cycle = append(cycle, '\r', '\n')
+	}
+
+	pattern := cycle
+	for len(pattern)+len(cycle) <= 64*1024 {
+		pattern = append(pattern, cycle...)
+	}
+	return pattern
+}()
+
+// ServeUDPEcho sends every packet received on pc back to its sender until ctx
+// is done.
+func ServeUDPEcho(ctx context.Context, pc net.PacketConn) error {
+	go func() {
+		<-ctx.Done()
+		pc.Close()
+	}()
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		packetsReceived.Inc(ModeEcho)
+		bytesReceived.Add(float64(n), "udp", ModeEcho)
+
+		n, err = pc.WriteTo(buf[:n], addr)
+		if err != nil {
+			logrus.Debugf("raw udp echo to %s: %v", addr, err)
+			continue
+		}
+		bytesSent.Add(float64(n), "udp", ModeEcho)
+	}
+}
+
+// countedBytesInterval is how often the bytes counted on a connection are
+// added to the metrics, so they are not updated for every read and write.
+const countedBytesInterval = time.Second
+
+// countedBytes counts bytes of one connection. It must not be used
+// concurrently.
+type countedBytes struct {
+	counter *metrics.CounterVec
+	labels  []string
+
+	pending   int64
+	lastFlush time.Time
+}
+
+func (c *countedBytes) add(n int) {
+	c.pending += int64(n)
+	if time.Since(c.lastFlush) >= countedBytesInterval {
+		c.flush()
+	}
+}
+
+// flush adds the pending bytes to the counter.
+func (c *countedBytes) flush() {
+	if c.pending > 0 {
+		c.counter.Add(float64(c.pending), c.labels...)
+		c.pending = 0
+	}
+	c.lastFlush = time.Now()
+}
+
+type countingReader struct {
+	r       io.Reader
+	counted countedBytes
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	if n > 0 {
+		c.counted.add(n)
+	}
+	return n, err
+}
+
+type countingWriter struct {
+	w       io.Writer
+	counted countedBytes
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	if n > 0 {
+		c.counted.add(n)
+	}
+	return n, err
+}
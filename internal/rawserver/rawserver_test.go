@@ -0,0 +1,98 @@
+package rawserver_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stormforger/testapp/internal/rawserver"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startTCP(t *testing.T, mode string) net.Conn {
+	return startTCPServer(t, &rawserver.TCPServer{Mode: mode})
+}
+
+func startTCPServer(t *testing.T, s *rawserver.TCPServer) net.Conn {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	go s.Serve(ctx, ln)
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	require.Nil(t, err)
+	t.Cleanup(func() { c.Close() })
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	return c
+}
+
+func TestTCPEcho(t *testing.T) {
+	c := startTCP(t, rawserver.ModeEcho)
+
+	_, err := c.Write([]byte("hello\n"))
+	require.Nil(t, err)
+	line, err := bufio.NewReader(c).ReadString('\n')
+	require.Nil(t, err)
+	assert.Equal(t, "hello\n", line)
+}
+
+func TestTCPChargen(t *testing.T) {
+	c := startTCP(t, rawserver.ModeChargen)
+
+	r := bufio.NewReader(c)
+	first, err := r.ReadString('\n')
+	require.Nil(t, err)
+	second, err := r.ReadString('\n')
+	require.Nil(t, err)
+
+	assert.Len(t, first, 74)
+	assert.Equal(t, " !\"#$%&", first[:7])
+	assert.Equal(t, first[1:72], second[:71])
+
+	// the lines repeat after one line per printable character
+	var line string
+	for i := 2; i <= 95*3; i++ {
+		line, err = r.ReadString('\n')
+		require.Nil(t, err)
+		if i%95 == 0 {
+			assert.Equal(t, first, line, i)
+		}
+	}
+}
+
+func TestTCPHangTimeout(t *testing.T) {
+	c := startTCPServer(t, &rawserver.TCPServer{Mode: rawserver.ModeHang, HangTimeout: 50 * time.Millisecond})
+
+	start := time.Now()
+	_, err := c.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+}
+
+func TestUDPEcho(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	go rawserver.ServeUDPEcho(ctx, pc)
+
+	c, err := net.Dial("udp", pc.LocalAddr().String())
+	require.Nil(t, err)
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = c.Write([]byte("ping"))
+	require.Nil(t, err)
+	b := make([]byte, 16)
+	n, err := c.Read(b)
+	require.Nil(t, err)
+	assert.Equal(t, "ping", string(b[:n]))
+}
@@ -0,0 +1,111 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// CertStore selects the server certificate by the server name (SNI) sent by
+// the client. Certificates are indexed by their DNS and IP subject
+// alternative names, wildcard names match a single label.
+type CertStore struct {
+	// Default is served to clients without SNI and, unless RejectUnknown is
+	// set, to clients requesting a name no certificate matches.
+	Default *tls.Certificate
+	// RejectUnknown fails the handshake for unknown server names.
+	RejectUnknown bool
+
+	names map[string]*tls.Certificate
+}
+
+// NewCertStore creates a store serving defaultCert to clients without SNI.
+func NewCertStore(defaultCert tls.Certificate) *CertStore {
+	return &CertStore{
+		Default: &defaultCert,
+		names:   map[string]*tls.Certificate{},
+	}
+}
+
+// Add indexes cert by the names of its leaf certificate. Names already in
+// the store are replaced.
+func (s *CertStore) Add(cert tls.Certificate) error {
+	if len(cert.Certificate) == 0 {
+		return errors.New("tlsutil: empty certificate")
+	}
+
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return err
+		}
+		cert.Leaf = leaf
+	}
+
+	names := leaf.DNSNames
+	for _, ip := range leaf.IPAddresses {
+		names = append(names, ip.String())
+	}
+	if len(names) == 0 && leaf.Subject.CommonName != "" {
+		names = []string{leaf.Subject.CommonName}
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("tlsutil: certificate %q has no names", leaf.Subject)
+	}
+
+	for _, name := range names {
+		s.names[strings.ToLower(name)] = &cert
+	}
+
+	return nil
+}
+
+// Names returns all names a certificate is available for, sorted.
+func (s *CertStore) Names() []string {
+	names := make([]string, 0, len(s.names))
+	for name := range s.names {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Lookup returns the certificate for serverName, trying an exact match
+// before a wildcard match.
+func (s *CertStore) Lookup(serverName string) (*tls.Certificate, bool) {
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+
+	if cert, exists := s.names[name]; exists {
+		return cert, true
+	}
+
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if cert, exists := s.names["*"+name[i:]]; exists {
+			return cert, true
+		}
+	}
+
+	return nil, false
+}
+
+// GetCertificate can be used as tls.Config.GetCertificate.
+func (s *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if hello.ServerName == "" {
+		return s.Default, nil
+	}
+
+	if cert, exists := s.Lookup(hello.ServerName); exists {
+		return cert, nil
+	}
+
+	if s.RejectUnknown {
+		return nil, fmt.Errorf("tlsutil: no certificate for server name %q", hello.ServerName)
+	}
+
+	return s.Default, nil
+}
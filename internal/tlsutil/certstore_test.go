@@ -0,0 +1,56 @@
+package tlsutil_test
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/stormforger/testapp/internal/pki"
+	"github.com/stormforger/testapp/internal/tlsutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCertStore(t *testing.T) {
+	ca, err := pki.NewAuthority("test CA", pki.KeyTypeECDSA, time.Hour)
+	require.Nil(t, err)
+
+	issue := func(hosts ...string) tls.Certificate {
+		key, err := pki.GenerateKey(pki.KeyTypeECDSA)
+		require.Nil(t, err)
+		cert, err := ca.Issue(pki.LeafTemplate(hosts, time.Now(), time.Now().Add(time.Hour)), key.Public())
+		require.Nil(t, err)
+		return pki.TLSCertificate(key, cert)
+	}
+
+	defaultCert := issue("localhost")
+	exact := issue("api.example.com")
+	wildcard := issue("*.example.com")
+
+	store := tlsutil.NewCertStore(defaultCert)
+	require.Nil(t, store.Add(exact))
+	require.Nil(t, store.Add(wildcard))
+	assert.Equal(t, []string{"*.example.com", "api.example.com"}, store.Names())
+
+	cases := []struct {
+		serverName string
+		expected   tls.Certificate
+	}{
+		{"", defaultCert},
+		{"API.example.com", exact},
+		{"www.example.com", wildcard},
+		{"a.b.example.com", defaultCert},
+		{"example.org", defaultCert},
+	}
+	for _, c := range cases {
+		cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: c.serverName})
+		require.Nil(t, err, c.serverName)
+		assert.Equal(t, c.expected.Certificate[0], cert.Certificate[0], c.serverName)
+	}
+
+	store.RejectUnknown = true
+	_, err = store.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.org"})
+	assert.NotNil(t, err)
+	_, err = store.GetCertificate(&tls.ClientHelloInfo{})
+	assert.Nil(t, err)
+}
@@ -0,0 +1,225 @@
+package tlsutil
+
+import (
+	"errors"
+)
+
+// TLS extension types used when parsing a ClientHello.
+const (
+	extensionServerName          uint16 = 0
+	extensionSupportedGroups     uint16 = 10
+	extensionECPointFormats      uint16 = 11
+	extensionSignatureAlgorithms uint16 = 13
+	extensionALPN                uint16 = 16
+	extensionSupportedVersions   uint16 = 43
+)
+
+// ClientHello is the raw content of a TLS ClientHello message, preserving
+// the order of all lists as sent by the client. GREASE values are included.
+type ClientHello struct {
+	Version             uint16
+	CipherSuites        []uint16
+	Extensions          []uint16
+	ServerName          string
+	SupportedGroups     []uint16
+	PointFormats        []uint8
+	SignatureAlgorithms []uint16
+	ALPNProtocols       []string
+	SupportedVersions   []uint16
+}
+
+var errShortClientHello = errors.New("tlsutil: truncated ClientHello")
+
+// ParseClientHello parses a ClientHello handshake message, starting with the
+// handshake header (RFC 8446 4.1.2).
+func ParseClientHello(msg []byte) (*ClientHello, error) {
+	s := byteString(msg)
+
+	var msgType uint8
+	if !s.readUint8(&msgType) {
+		return nil, errShortClientHello
+	}
+	if msgType != 1 {
+		return nil, errors.New("tlsutil: not a ClientHello")
+	}
+
+	var body byteString
+	if !s.readLengthPrefixed(3, &body) {
+		return nil, errShortClientHello
+	}
+
+	hello := &ClientHello{}
+	var sessionID, cipherSuites, compression byteString
+	if !body.readUint16(&hello.Version) ||
+		!body.skip(32) ||
+		!body.readLengthPrefixed(1, &sessionID) ||
+		!body.readLengthPrefixed(2, &cipherSuites) ||
+		!body.readLengthPrefixed(1, &compression) {
+		return nil, errShortClientHello
+	}
+
+	for !cipherSuites.empty() {
+		var suite uint16
+		if !cipherSuites.readUint16(&suite) {
+			return nil, errShortClientHello
+		}
+		hello.CipherSuites = append(hello.CipherSuites, suite)
+	}
+
+	if body.empty() {
+		// no extensions, e.g. SSL 3.0 clients
+		return hello, nil
+	}
+
+	var extensions byteString
+	if !body.readLengthPrefixed(2, &extensions) {
+		return nil, errShortClientHello
+	}
+
+	for !extensions.empty() {
+		var extType uint16
+		var data byteString
+		if !extensions.readUint16(&extType) || !extensions.readLengthPrefixed(2, &data) {
+			return nil, errShortClientHello
+		}
+		hello.Extensions = append(hello.Extensions, extType)
+
+		if err := hello.parseExtension(extType, data); err != nil {
+			return nil, err
+		}
+	}
+
+	return hello, nil
+}
+
+func (hello *ClientHello) parseExtension(extType uint16, data byteString) error {
+	switch extType {
+	case extensionServerName:
+		var names byteString
+		if !data.readLengthPrefixed(2, &names) {
+			return errShortClientHello
+		}
+		for !names.empty() {
+			var nameType uint8
+			var name byteString
+			if !names.readUint8(&nameType) || !names.readLengthPrefixed(2, &name) {
+				return errShortClientHello
+			}
+			if nameType == 0 {
+				hello.ServerName = string(name)
+			}
+		}
+
+	case extensionSupportedGroups:
+		var groups byteString
+		if !data.readLengthPrefixed(2, &groups) {
+			return errShortClientHello
+		}
+		for !groups.empty() {
+			var group uint16
+			if !groups.readUint16(&group) {
+				return errShortClientHello
+			}
+			hello.SupportedGroups = append(hello.SupportedGroups, group)
+		}
+
+	case extensionECPointFormats:
+		var formats byteString
+		if !data.readLengthPrefixed(1, &formats) {
+			return errShortClientHello
+		}
+		hello.PointFormats = append(hello.PointFormats, formats...)
+
+	case extensionSignatureAlgorithms:
+		var algorithms byteString
+		if !data.readLengthPrefixed(2, &algorithms) {
+			return errShortClientHello
+		}
+		for !algorithms.empty() {
+			var algorithm uint16
+			if !algorithms.readUint16(&algorithm) {
+				return errShortClientHello
+			}
+			hello.SignatureAlgorithms = append(hello.SignatureAlgorithms, algorithm)
+		}
+
+	case extensionALPN:
+		var protocols byteString
+		if !data.readLengthPrefixed(2, &protocols) {
+			return errShortClientHello
+		}
+		for !protocols.empty() {
+			var protocol byteString
+			if !protocols.readLengthPrefixed(1, &protocol) {
+				return errShortClientHello
+			}
+			hello.ALPNProtocols = append(hello.ALPNProtocols, string(protocol))
+		}
+
+	case extensionSupportedVersions:
+		var versions byteString
+		if !data.readLengthPrefixed(1, &versions) {
+			return errShortClientHello
+		}
+		for !versions.empty() {
+			var version uint16
+			if !versions.readUint16(&version) {
+				return errShortClientHello
+			}
+			hello.SupportedVersions = append(hello.SupportedVersions, version)
+		}
+	}
+
+	return nil
+}
+
+// byteString is a minimal cursor over TLS wire data.
+type byteString []byte
+
+func (s *byteString) empty() bool {
+	return len(*s) == 0
+}
+
+func (s *byteString) skip(n int) bool {
+	if len(*s) < n {
+		return false
+	}
+	*s = (*s)[n:]
+	return true
+}
+
+func (s *byteString) readUint8(v *uint8) bool {
+	if len(*s) < 1 {
+		return false
+	}
+	*v = (*s)[0]
+	*s = (*s)[1:]
+	return true
+}
+
+func (s *byteString) readUint16(v *uint16) bool {
+	if len(*s) < 2 {
+		return false
+	}
+	*v = uint16((*s)[0])<<8 | uint16((*s)[1])
+	*s = (*s)[2:]
+	return true
+}
+
+// readLengthPrefixed reads a value prefixed by a big endian length of
+// lenBytes bytes.
+func (s *byteString) readLengthPrefixed(lenBytes int, out *byteString) bool {
+	if len(*s) < lenBytes {
+		return false
+	}
+	length := 0
+	for _, b := range (*s)[:lenBytes] {
+		length = length<<8 | int(b)
+	}
+	if len(*s) < lenBytes+length {
+		return false
+	}
+	*out = (*s)[lenBytes : lenBytes+length]
+	*s = (*s)[lenBytes+length:]
+	return true
+}
@@ -0,0 +1,172 @@
+package tlsutil
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// JA3 returns the JA3 fingerprint string of the ClientHello and its MD5 hash.
+// See https://github.com/salesforce/ja3
+func (hello *ClientHello) JA3() (string, string) {
+	fields := []string{
+		strconv.Itoa(int(hello.Version)),
+		joinDecimal(withoutGrease(hello.CipherSuites)),
+		joinDecimal(withoutGrease(hello.Extensions)),
+		joinDecimal(withoutGrease(hello.SupportedGroups)),
+	}
+
+	formats := make([]string, len(hello.PointFormats))
+	for i, f := range hello.PointFormats {
+		formats[i] = strconv.Itoa(int(f))
+	}
+	fields = append(fields, strings.Join(formats, "-"))
+
+	ja3 := strings.Join(fields, ",")
+	sum := md5.Sum([]byte(ja3))
+
+	return ja3, hex.EncodeToString(sum[:])
+}
+
+// JA4 returns the JA4 fingerprint of the ClientHello received via TCP and
+// its raw, unhashed variant (JA4_r).
+// See https://github.com/FoxIO-LLC/ja4/blob/main/technical_details/JA4.md
+func (hello *ClientHello) JA4() (string, string) {
+	ciphers := withoutGrease(hello.CipherSuites)
+	extensions := withoutGrease(hello.Extensions)
+
+	sni := "i"
+	if hello.ServerName != "" {
+		sni = "d"
+	}
+
+	a := fmt.Sprintf("t%s%s%02d%02d%s",
+		ja4Version(hello.highestVersion()),
+		sni,
+		capCount(len(ciphers)),
+		capCount(len(extensions)),
+		ja4ALPN(hello.ALPNProtocols),
+	)
+
+	sortedCiphers := sortedHex(ciphers)
+
+	// the SNI and ALPN extensions are already represented in part a
+	var hashedExtensions []uint16
+	for _, e := range extensions {
+		if e != extensionServerName && e != extensionALPN {
+			hashedExtensions = append(hashedExtensions, e)
+		}
+	}
+	c := sortedHex(hashedExtensions)
+	if len(hello.SignatureAlgorithms) > 0 {
+		c += "_" + joinHex(hello.SignatureAlgorithms)
+	}
+
+	ja4 := a + "_" + truncatedHash(sortedCiphers) + "_" + truncatedHash(c)
+	ja4r := a + "_" + sortedCiphers + "_" + c
+
+	return ja4, ja4r
+}
+
+// highestVersion returns the highest offered TLS version, taking the
+// supported_versions extension into account.
+func (hello *ClientHello) highestVersion() uint16 {
+	version := hello.Version
+	for _, v := range withoutGrease(hello.SupportedVersions) {
+		if v > version {
+			version = v
+		}
+	}
+	return version
+}
+
+func ja4Version(version uint16) string {
+	switch version {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	case 0x0002:
+		return "s2"
+	default:
+		return "00"
+	}
+}
+
+// ja4ALPN returns the first and last character of the first ALPN value, or
+// the first and last hex digit if one of them is not alphanumeric.
+func ja4ALPN(protocols []string) string {
+	if len(protocols) == 0 || protocols[0] == "" {
+		return "00"
+	}
+
+	p := protocols[0]
+	first, last := p[0], p[len(p)-1]
+	if !isAlphanumeric(first) || !isAlphanumeric(last) {
+		h := hex.EncodeToString([]byte(p))
+		return string(h[0]) + string(h[len(h)-1])
+	}
+
+	return string(first) + string(last)
+}
+
+func isAlphanumeric(b byte) bool {
+	return (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9')
+}
+
+func capCount(n int) int {
+	if n > 99 {
+		return 99
+	}
+	return n
+}
+
+func truncatedHash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func withoutGrease(values []uint16) []uint16 {
+	var filtered []uint16
+	for _, v := range values {
+		if !IsGrease(v) {
+			filtered = append(filtered, v)
+		}
+	}
+	return filtered
+}
+
+func joinDecimal(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = strconv.Itoa(int(v))
+	}
+	return strings.Join(parts, "-")
+}
+
+func joinHex(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = fmt.Sprintf("%04x", v)
+	}
+	return strings.Join(parts, ",")
+}
+
+func sortedHex(values []uint16) string {
+	sorted := append([]uint16(nil), values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return joinHex(sorted)
+}
@@ -0,0 +1,128 @@
+package tlsutil_test
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stormforger/testapp/internal/pki"
+	"github.com/stormforger/testapp/internal/tlsutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJA3(t *testing.T) {
+	// example from https://github.com/salesforce/ja3
+	hello := &tlsutil.ClientHello{
+		Version:         769,
+		CipherSuites:    []uint16{47, 53, 5, 10, 49161, 49162, 49171, 49172, 50, 56, 19, 4},
+		Extensions:      []uint16{0, 10, 11},
+		SupportedGroups: []uint16{23, 24, 25},
+		PointFormats:    []uint8{0},
+	}
+
+	ja3, hash := hello.JA3()
+	assert.Equal(t, "769,47-53-5-10-49161-49162-49171-49172-50-56-19-4,0-10-11,23-24-25,0", ja3)
+	assert.Equal(t, "ada70206e40642a3e4461f35503241d5", hash)
+}
+
+func TestJA4(t *testing.T) {
+	// Chrome example from https://github.com/FoxIO-LLC/ja4, with GREASE values
+	hello := &tlsutil.ClientHello{
+		Version:             0x0303,
+		CipherSuites:        []uint16{0x0a0a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035},
+		Extensions:          []uint16{0x1a1a, 0x0000, 0x0017, 0xff01, 0x000a, 0x000b, 0x0023, 0x0010, 0x0005, 0x000d, 0x0012, 0x0033, 0x002d, 0x002b, 0x001b, 0x4469, 0x0015},
+		ServerName:          "example.com",
+		SignatureAlgorithms: []uint16{0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601},
+		ALPNProtocols:       []string{"h2", "http/1.1"},
+		SupportedVersions:   []uint16{0x2a2a, 0x0304, 0x0303},
+	}
+
+	ja4, ja4r := hello.JA4()
+	assert.Equal(t, "t13d1516h2_8daaf6152771_e5627efa2ab1", ja4)
+	assert.Equal(t, "t13d1516h2_002f,0035,009c,009d,1301,1302,1303,c013,c014,c02b,c02c,c02f,c030,cca8,cca9_0005,000a,000b,000d,0012,0015,0017,001b,0023,002b,002d,0033,4469,ff01_0403,0804,0401,0503,0805,0501,0806,0601", ja4r)
+}
+
+func TestClientHelloListener(t *testing.T) {
+	ca, err := pki.NewAuthority("test CA", pki.KeyTypeECDSA, time.Hour)
+	require.Nil(t, err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	ln := tlsutil.NewClientHelloListener(l)
+	defer ln.Close()
+
+	serverConn := make(chan net.Conn)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			close(serverConn)
+			return
+		}
+		tc := tls.Server(c, &tls.Config{Certificates: []tls.Certificate{pki.TLSCertificate(ca.Key, ca.Cert)}})
+		tc.Handshake()
+		serverConn <- tc
+	}()
+
+	client, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         "testapp.example",
+		NextProtos:         []string{"http/1.1"},
+	})
+	require.Nil(t, err)
+	defer client.Close()
+
+	c := <-serverConn
+	require.NotNil(t, c)
+	defer c.Close()
+
+	hello := tlsutil.ClientHelloFromConn(c)
+	require.NotNil(t, hello)
+	assert.Equal(t, "testapp.example", hello.ServerName)
+	assert.Equal(t, []string{"http/1.1"}, hello.ALPNProtocols)
+	assert.Contains(t, hello.SupportedVersions, uint16(tls.VersionTLS13))
+
+	ja4, _ := hello.JA4()
+	assert.Regexp(t, `^t13d\d{4}h1_[0-9a-f]{12}_[0-9a-f]{12}$`, ja4)
+}
+
+// connListener accepts conn once.
+type connListener struct {
+	net.Listener
+	conn net.Conn
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	return l.conn, nil
+}
+
+func TestClientHelloListenerFollowingRecord(t *testing.T) {
+	// capture a ClientHello record as sent by crypto/tls
+	clientConn, raw := net.Pipe()
+	go tls.Client(clientConn, &tls.Config{ServerName: "testapp.example"}).Handshake()
+	header := make([]byte, 5)
+	_, err := io.ReadFull(raw, header)
+	require.Nil(t, err)
+	record := make([]byte, 5+(int(header[3])<<8|int(header[4])))
+	copy(record, header)
+	_, err = io.ReadFull(raw, record[5:])
+	require.Nil(t, err)
+	raw.Close()
+
+	// the ClientHello and a ChangeCipherSpec record are read at once
+	client, server := net.Pipe()
+	defer client.Close()
+	c, err := tlsutil.NewClientHelloListener(&connListener{conn: server}).Accept()
+	require.Nil(t, err)
+	defer c.Close()
+
+	go client.Write(append(record, 20, 3, 3, 0, 1, 1))
+	_, err = c.Read(make([]byte, 64*1024))
+	require.Nil(t, err)
+
+	hello := tlsutil.ClientHelloFromConn(c)
+	require.NotNil(t, hello)
+	assert.Equal(t, "testapp.example", hello.ServerName)
+}
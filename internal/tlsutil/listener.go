@@ -0,0 +1,133 @@
+package tlsutil
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/stormforger/testapp/internal/conninfo"
+)
+
+// maxClientHelloSize limits how much data is buffered while waiting for a
+// complete ClientHello.
+const maxClientHelloSize = 64 * 1024
+
+// NewClientHelloListener wraps l so that the raw ClientHello of every
+// accepted connection is captured while the TLS handshake reads it.
+func NewClientHelloListener(l net.Listener) net.Listener {
+	return &clientHelloListener{l}
+}
+
+type clientHelloListener struct {
+	net.Listener
+}
+
+func (l *clientHelloListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ClientHelloConn{Conn: c, capturing: true}, nil
+}
+
+// ClientHelloConn records the first ClientHello read from the connection.
+type ClientHelloConn struct {
+	net.Conn
+
+	mu        sync.Mutex
+	capturing bool
+	buf       []byte
+	hello     *ClientHello
+}
+
+// NetConn returns the wrapped connection.
+func (c *ClientHelloConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *ClientHelloConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.mu.Lock()
+		if c.capturing {
+			c.capture(b[:n])
+		}
+		c.mu.Unlock()
+	}
+
+	return n, err
+}
+
+// ClientHello returns the captured ClientHello, or nil if none has been
+// received (yet) or it could not be parsed.
+func (c *ClientHelloConn) ClientHello() *ClientHello {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.hello
+}
+
+// capture collects the handshake records read so far and parses the
+// ClientHello once it is complete. Capturing stops at the first record that is
+// not a handshake record, e.g. a ChangeCipherSpec or early data sent along
+// with the ClientHello, after parsing the handshake records before it.
+func (c *ClientHelloConn) capture(data []byte) {
+	c.buf = append(c.buf, data...)
+
+	var handshake []byte
+	records := c.buf
+	complete := false
+	for len(records) >= 5 {
+		if records[0] != 22 { // not a handshake record
+			complete = true
+			break
+		}
+
+		length := int(records[3])<<8 | int(records[4])
+		if len(records) < 5+length {
+			break
+		}
+		handshake = append(handshake, records[5:5+length]...)
+		records = records[5+length:]
+	}
+
+	if len(handshake) >= 4 {
+		length := int(handshake[1])<<16 | int(handshake[2])<<8 | int(handshake[3])
+		if len(handshake) >= 4+length {
+			c.hello, _ = ParseClientHello(handshake[:4+length])
+			c.stopCapture()
+			return
+		}
+	}
+
+	if complete || len(c.buf) > maxClientHelloSize {
+		c.stopCapture()
+	}
+}
+
+func (c *ClientHelloConn) stopCapture() {
+	c.capturing = false
+	c.buf = nil
+}
+
+// ClientHelloFromConn returns the ClientHello captured by a ClientHelloConn
+// wrapped by c, or nil.
+func ClientHelloFromConn(c net.Conn) *ClientHello {
+	var hello *ClientHello
+	conninfo.Walk(c, func(c net.Conn) bool {
+		if hc, ok := c.(*ClientHelloConn); ok {
+			hello = hc.ClientHello()
+			return true
+		}
+		return false
+	})
+
+	return hello
+}
+
+// ClientHelloFromContext returns the ClientHello of the connection stored in
+// ctx by conninfo.ConnContext, or nil.
+func ClientHelloFromContext(ctx context.Context) *ClientHello {
+	return ClientHelloFromConn(conninfo.FromContext(ctx))
+}
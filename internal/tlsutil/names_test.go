@@ -0,0 +1,62 @@
+package tlsutil_test
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/stormforger/testapp/internal/tlsutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseVersion(t *testing.T) {
+	for name, expected := range map[string]uint16{
+		"TLS 1.2": tls.VersionTLS12,
+		"TLS1.3":  tls.VersionTLS13,
+		"tls 1.0": tls.VersionTLS10,
+		"1.1":     tls.VersionTLS11,
+		"SSL 3.0": 0x0300,
+	} {
+		version, err := tlsutil.ParseVersion(name)
+		assert.Nil(t, err, name)
+		assert.Equal(t, expected, version, name)
+	}
+
+	for _, name := range []string{"", "1.4", "TLS", "SSL 2.0", "TLS 1.2.1"} {
+		_, err := tlsutil.ParseVersion(name)
+		assert.NotNil(t, err, name)
+	}
+}
+
+func TestParseCipherSuite(t *testing.T) {
+	for name, expected := range map[string]uint16{
+		"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256": tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		"tls_aes_256_gcm_sha384":                tls.TLS_AES_256_GCM_SHA384,
+	} {
+		suite, err := tlsutil.ParseCipherSuite(name)
+		assert.Nil(t, err, name)
+		assert.Equal(t, expected, suite, name)
+	}
+
+	for _, name := range []string{"", "AES128-GCM-SHA256", "TLS_ECDHE_RSA_WITH_AES_128_GCM"} {
+		_, err := tlsutil.ParseCipherSuite(name)
+		assert.NotNil(t, err, name)
+	}
+}
+
+func TestParseCurve(t *testing.T) {
+	for name, expected := range map[string]tls.CurveID{
+		"x25519":    tls.X25519,
+		"secp256r1": tls.CurveP256,
+		"P-384":     tls.CurveP384,
+		"p-521":     tls.CurveP521,
+	} {
+		curve, err := tlsutil.ParseCurve(name)
+		assert.Nil(t, err, name)
+		assert.Equal(t, expected, curve, name)
+	}
+
+	for _, name := range []string{"", "P-192", "curve25519"} {
+		_, err := tlsutil.ParseCurve(name)
+		assert.NotNil(t, err, name)
+	}
+}
@@ -3,13 +3,21 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
+	"github.com/stormforger/testapp/internal/conninfo"
+	"github.com/stormforger/testapp/internal/metrics"
+	"github.com/stormforger/testapp/internal/proxyproto"
+	"github.com/stormforger/testapp/internal/rawserver"
+	"github.com/stormforger/testapp/internal/tlsutil"
 	"github.com/stormforger/testapp/internal/ulimit"
 	"github.com/stormforger/testapp/server"
 )
@@ -20,10 +28,46 @@ type testAppConfig struct {
 	ShutdownCode          string
 	HttpReadTimeout       time.Duration
 	HttpWriteTimeout      time.Duration
+	HttpIdleTimeout       time.Duration
+	MaxRequestsPerConn    uint64
+	CompressMinSize       int
+	MaxBodySize           int64
+	Forms                 server.FormsConfig
+	EchoMaxBodySize       int64
 	DisableTLS            bool
+	ProxyProtocol         bool
+	ProxyProtocolTrusted  []*net.IPNet
+	TrustedProxies        []*net.IPNet
+	AccessLog             bool
+	SessionSecret         string
+	AuthUsers             server.AuthUsers
 	ServerCertificateFile string
 	ServerPrivateKeyFile  string
+	TLSCertDir            string
+	TLSUnknownSNI         string
+	BadTLSDomain          string
+	VirtualHosts          server.VirtualHosts
+	TLS                   tlsSettings
+	TLSInspection         bool
 	DebugTLS              bool
+	TLSClientsHistory     int
+
+	TLSAutogenerate         string
+	TLSAutogenerateSANs     []string
+	TLSAutogenerateKeyType  string
+	TLSAutogenerateValidity time.Duration
+	TLSAutogenerateOut      string
+
+	ACMEChallenge  string
+	ACMEHTTP01Port string
+
+	// raw TCP and UDP servers, disabled if the port is empty
+	TCPEchoPort    string
+	TCPDiscardPort string
+	TCPChargenPort string
+	TCPHangPort    string
+	TCPHangTimeout time.Duration
+	UDPEchoPort    string
 }
 
 func configFromENV() testAppConfig {
@@ -41,10 +85,102 @@ func configFromENV() testAppConfig {
 	}
 
 	disableTLS := getEnv("DISABLE_TLS", "false") == "true"
+
+	trustedProxies, err := parseCIDRs(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		logrus.WithError(err).Fatal("TRUSTED_PROXIES parsing failed")
+	}
+
+	// loopback and private ranges, where load balancers usually live
+	proxyProtocolTrusted, err := parseCIDRs(getEnv("PROXY_PROTOCOL_TRUSTED", "127.0.0.0/8,::1/128,10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,fc00::/7"))
+	if err != nil {
+		logrus.WithError(err).Fatal("PROXY_PROTOCOL_TRUSTED parsing failed")
+	}
 	serverCertificateFile := getEnv("TLS_CERT", "data/pki/server.cert.pem")
 	serverPrivateKeyFile := getEnv("TLS_KEY", "data/pki/server.key.pem")
 
-	tlsConnectionInspection := getEnv("TLS_DEBUG", "false") == "true"
+	tlsUnknownSNI := getEnv("TLS_UNKNOWN_SNI", "default")
+	if tlsUnknownSNI != "default" && tlsUnknownSNI != "reject" {
+		logrus.Fatalf("TLS_UNKNOWN_SNI must be default or reject, got %q", tlsUnknownSNI)
+	}
+
+	virtualHosts, err := server.ParseVirtualHosts(os.Getenv("VHOSTS"))
+	if err != nil {
+		logrus.WithError(err).Fatal("VHOSTS parsing failed")
+	}
+
+	httpIdleTimeout, err := time.ParseDuration(getEnv("HTTP_IDLE_TIMEOUT", "0s"))
+	if err != nil {
+		logrus.WithError(err).Fatal("HTTP_IDLE_TIMEOUT parsing failed")
+	}
+
+	maxRequestsPerConn, err := strconv.ParseUint(getEnv("MAX_REQUESTS_PER_CONN", "0"), 10, 64)
+	if err != nil {
+		logrus.Fatalf("MAX_REQUESTS_PER_CONN must be a non-negative number, got %q", os.Getenv("MAX_REQUESTS_PER_CONN"))
+	}
+
+	compressMinSize, err := strconv.Atoi(getEnv("COMPRESS_MIN_SIZE", "0"))
+	if err != nil || compressMinSize < 0 {
+		logrus.Fatalf("COMPRESS_MIN_SIZE must be a non-negative number, got %q", os.Getenv("COMPRESS_MIN_SIZE"))
+	}
+
+	maxBodySize, err := strconv.ParseInt(getEnv("MAX_BODY_SIZE", strconv.Itoa(server.DefaultMaxBodySize)), 10, 64)
+	if err != nil || maxBodySize < 0 {
+		logrus.Fatalf("MAX_BODY_SIZE must be a non-negative number, got %q", os.Getenv("MAX_BODY_SIZE"))
+	}
+
+	formMaxParts, err := strconv.Atoi(getEnv("FORM_MAX_PARTS", "1000"))
+	if err != nil || formMaxParts < 0 {
+		logrus.Fatalf("FORM_MAX_PARTS must be a non-negative number, got %q", os.Getenv("FORM_MAX_PARTS"))
+	}
+	formMaxFileSize, err := strconv.ParseInt(getEnv("FORM_MAX_FILE_SIZE", "0"), 10, 64)
+	if err != nil || formMaxFileSize < 0 {
+		logrus.Fatalf("FORM_MAX_FILE_SIZE must be a non-negative number, got %q", os.Getenv("FORM_MAX_FILE_SIZE"))
+	}
+
+	echoMaxBodySize, err := strconv.ParseInt(getEnv("ECHO_MAX_BODY", strconv.Itoa(server.DefaultEchoMaxBodySize)), 10, 64)
+	if err != nil || echoMaxBodySize < 0 {
+		logrus.Fatalf("ECHO_MAX_BODY must be a non-negative number, got %q", os.Getenv("ECHO_MAX_BODY"))
+	}
+
+	var authUsers server.AuthUsers
+	if path := os.Getenv("AUTH_USERS_FILE"); path != "" {
+		if authUsers, err = server.LoadAuthUsers(path); err != nil {
+			logrus.WithError(err).Fatal("AUTH_USERS_FILE parsing failed")
+		}
+	}
+
+	tlsSettings, err := tlsSettingsFromENV()
+	if err != nil {
+		logrus.WithError(err).Fatal("TLS settings parsing failed")
+	}
+
+	tlsConnectionInspection := getEnv("TLS_INSPECTION", "true") == "true"
+	debugTLS := getEnv("TLS_DEBUG", "false") == "true"
+	if debugTLS && !tlsConnectionInspection {
+		logrus.Fatal("TLS_DEBUG requires TLS_INSPECTION")
+	}
+	tlsClientsHistory, err := strconv.Atoi(getEnv("TLS_CLIENTS_HISTORY", "100"))
+	if err != nil || tlsClientsHistory < 0 {
+		logrus.Fatalf("TLS_CLIENTS_HISTORY must be a non-negative number, got %q", os.Getenv("TLS_CLIENTS_HISTORY"))
+	}
+
+	tlsAutogenerate := getEnv("TLS_AUTOGENERATE", "auto")
+	if tlsAutogenerate != "true" && tlsAutogenerate != "false" && tlsAutogenerate != "auto" {
+		logrus.Fatalf("TLS_AUTOGENERATE must be true, false or auto, got %q", tlsAutogenerate)
+	}
+	tlsAutogenerateValidity, err := time.ParseDuration(getEnv("TLS_AUTOGENERATE_VALIDITY", "720h"))
+	if err != nil {
+		logrus.WithError(err).Fatal("TLS_AUTOGENERATE_VALIDITY parsing failed")
+	}
+
+	tcpHangTimeout, err := time.ParseDuration(getEnv("TCP_HANG_TIMEOUT", rawserver.DefaultHangTimeout.String()))
+	if err != nil {
+		logrus.WithError(err).Fatal("TCP_HANG_TIMEOUT parsing failed")
+	}
+	if tcpHangTimeout <= 0 {
+		logrus.Fatalf("TCP_HANG_TIMEOUT must be positive, got %q", os.Getenv("TCP_HANG_TIMEOUT"))
+	}
 
 	return testAppConfig{
 		Port:                  port,
@@ -52,10 +188,45 @@ func configFromENV() testAppConfig {
 		ShutdownCode:          shutdownCode,
 		HttpReadTimeout:       httpReadTimeout,
 		HttpWriteTimeout:      httpWriteTimeout,
+		HttpIdleTimeout:       httpIdleTimeout,
+		MaxRequestsPerConn:    maxRequestsPerConn,
+		CompressMinSize:       compressMinSize,
+		MaxBodySize:           maxBodySize,
+		Forms:                 server.FormsConfig{MaxParts: formMaxParts, MaxFileSize: formMaxFileSize},
+		EchoMaxBodySize:       echoMaxBodySize,
 		DisableTLS:            disableTLS,
+		ProxyProtocol:         getEnv("PROXY_PROTOCOL", "false") == "true",
+		ProxyProtocolTrusted:  proxyProtocolTrusted,
+		TrustedProxies:        trustedProxies,
+		AccessLog:             getEnv("ACCESS_LOG", "false") == "true",
+		SessionSecret:         os.Getenv("SESSION_SECRET"),
+		AuthUsers:             authUsers,
 		ServerCertificateFile: serverCertificateFile,
 		ServerPrivateKeyFile:  serverPrivateKeyFile,
-		DebugTLS:              tlsConnectionInspection,
+		TLSCertDir:            os.Getenv("TLS_CERT_DIR"),
+		TLSUnknownSNI:         tlsUnknownSNI,
+		BadTLSDomain:          os.Getenv("BADTLS_DOMAIN"),
+		VirtualHosts:          virtualHosts,
+		TLS:                   tlsSettings,
+		TLSInspection:         tlsConnectionInspection,
+		DebugTLS:              debugTLS,
+		TLSClientsHistory:     tlsClientsHistory,
+
+		TLSAutogenerate:         tlsAutogenerate,
+		TLSAutogenerateSANs:     splitList(getEnv("TLS_AUTOGENERATE_SANS", "localhost,127.0.0.1,::1")),
+		TLSAutogenerateKeyType:  getEnv("TLS_AUTOGENERATE_KEY_TYPE", "ecdsa"),
+		TLSAutogenerateValidity: tlsAutogenerateValidity,
+		TLSAutogenerateOut:      os.Getenv("TLS_AUTOGENERATE_OUT"),
+
+		ACMEChallenge:  getEnv("ACME_CHALLENGE", "auto"),
+		ACMEHTTP01Port: getEnv("ACME_HTTP01_PORT", "80"),
+
+		TCPEchoPort:    os.Getenv("TCP_ECHO_PORT"),
+		TCPDiscardPort: os.Getenv("TCP_DISCARD_PORT"),
+		TCPChargenPort: os.Getenv("TCP_CHARGEN_PORT"),
+		TCPHangPort:    os.Getenv("TCP_HANG_PORT"),
+		TCPHangTimeout: tcpHangTimeout,
+		UDPEchoPort:    os.Getenv("UDP_ECHO_PORT"),
 	}
 }
 
@@ -69,19 +240,56 @@ func main() {
 		logrus.WithError(err).Error("failed to change ulimit")
 	}
 
+	var certificates serverPKI
+	var certStore *tlsutil.CertStore
+	if !config.DisableTLS {
+		var err error
+		certificates, err = loadServerPKI(config)
+		if err != nil {
+			logrus.WithError(err).Fatal("loading TLS certificates failed")
+		}
+		certStore, err = loadCertStore(config, certificates.Certificate)
+		if err != nil {
+			logrus.WithError(err).Fatal("loading TLS certificates failed")
+		}
+	}
+
+	tlsClients := newTLSCollector(config.TLSClientsHistory, config.DebugTLS)
+
 	ctx, cancel := context.WithCancel(context.Background()) // create a context for the shutdown handler to kill the servers
-	r := provideServerHandler(config, cancel)
+	r := provideServerHandler(config, certificates, tlsClients, cancel)
 
 	if !config.DisableTLS {
-		httpsServer := provideHttpsServer(r, config)
+		httpsServer := provideHttpsServer(r, config, certStore)
 
-		if config.DebugTLS {
-			setupTLSConnectionInspection(httpsServer)
+		if config.TLS.SessionTicketRotation > 0 {
+			if err := rotateSessionTicketKeys(ctx, httpsServer.TLSConfig, config.TLS.SessionTicketRotation); err != nil {
+				logrus.WithError(err).Fatal("generating session ticket keys failed")
+			}
+		}
+		if config.BadTLSDomain != "" {
+			if err := setupBadTLS(httpsServer, config.BadTLSDomain, certificates, config.TLSAutogenerateValidity); err != nil {
+				logrus.WithError(err).Fatal("generating broken TLS configurations failed")
+			}
+		}
+		if config.TLSInspection {
+			setupTLSConnectionInspection(httpsServer, tlsClients)
 		}
 
 		logrus.Infof("Starting HTTPS server at %s", httpsServer.Addr)
 		go func() {
-			err := httpsServer.ListenAndServeTLS(config.ServerCertificateFile, config.ServerPrivateKeyFile)
+			ln, err := listen(httpsServer.Addr, config)
+			if err != nil {
+				logrus.Fatal(err)
+			}
+
+			if config.TLSInspection {
+				ln = tlsutil.NewClientHelloListener(ln)
+			}
+
+			// not using ServeTLS, which serves a copy of TLSConfig and
+			// always offers http/1.1 via ALPN
+			err = httpsServer.Serve(tls.NewListener(ln, httpsServer.TLSConfig))
 			if err != nil && err != http.ErrServerClosed {
 				logrus.Fatal(err)
 			}
@@ -94,12 +302,19 @@ func main() {
 		}()
 	}
 
+	startRawServers(ctx, config)
+
 	// HTTP Server
 	httpServer := provideHttpServer(r, config)
 
 	logrus.Infof("Starting HTTP server at :%s", httpServer.Addr)
 	go func() {
-		err := httpServer.ListenAndServe()
+		ln, err := listen(httpServer.Addr, config)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+
+		err = httpServer.Serve(ln)
 		if err != nil && err != http.ErrServerClosed {
 			logrus.Fatal(err)
 		}
@@ -117,7 +332,89 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
-func provideServerHandler(config testAppConfig, cancel context.CancelFunc) http.Handler {
+// splitList splits a comma separated list, ignoring empty elements.
+func splitList(value string) []string {
+	var list []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// startRawServers starts the configured raw TCP and UDP servers.
+func startRawServers(ctx context.Context, config testAppConfig) {
+	tcpServers := []struct {
+		port string
+		mode string
+	}{
+		{config.TCPEchoPort, rawserver.ModeEcho},
+		{config.TCPDiscardPort, rawserver.ModeDiscard},
+		{config.TCPChargenPort, rawserver.ModeChargen},
+		{config.TCPHangPort, rawserver.ModeHang},
+	}
+	for _, t := range tcpServers {
+		if t.port == "" {
+			continue
+		}
+
+		ln, err := net.Listen("tcp", ":"+t.port)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+
+		logrus.Infof("Starting TCP %s server at :%s", t.mode, t.port)
+		s := &rawserver.TCPServer{Mode: t.mode, HangTimeout: config.TCPHangTimeout}
+		go func() {
+			if err := s.Serve(ctx, ln); err != nil {
+				logrus.Fatal(err)
+			}
+		}()
+	}
+
+	if config.UDPEchoPort != "" {
+		pc, err := net.ListenPacket("udp", ":"+config.UDPEchoPort)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+
+		logrus.Infof("Starting UDP echo server at :%s", config.UDPEchoPort)
+		go func() {
+			if err := rawserver.ServeUDPEcho(ctx, pc); err != nil {
+				logrus.Fatal(err)
+			}
+		}()
+	}
+}
+
+// parseCIDRs parses a comma separated list of CIDRs.
+func parseCIDRs(value string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, v := range splitList(value) {
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, n)
+	}
+	return networks, nil
+}
+
+// listen opens a TCP listener, parsing PROXY protocol headers if enabled.
+func listen(addr string, config testAppConfig) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.ProxyProtocol {
+		return proxyproto.NewListener(ln, config.ProxyProtocolTrusted), nil
+	}
+	return ln, nil
+}
+
+func provideServerHandler(config testAppConfig, certificates serverPKI, tlsClients *tlsCollector, cancel context.CancelFunc) http.Handler {
 	r := mux.NewRouter()
 	// Install our command routes
 	x := r.PathPrefix("/cmd").Subrouter()
@@ -132,15 +429,44 @@ func provideServerHandler(config testAppConfig, cancel context.CancelFunc) http.
 	})
 
 	// Demo Server Routes
+	if len(config.VirtualHosts) > 0 {
+		r.Use(config.VirtualHosts.Middleware)
+	}
+	r.Use(server.TLSResumedMiddleware)
 	r.Use(server.DelayMiddleware)
+	r.Use(server.NewRequestBodyMiddleware(config.MaxBodySize))
 	r.Use(server.ReadRequestBodyMiddleware)
-	r.Use(handlers.CompressHandler)
-	server.RegisterTestAppRoutes(r)
+	r.Use(server.NewCompressMiddleware(config.CompressMinSize))
+	server.RegisterTestAppRoutes(r, server.NewCookieSigner([]byte(config.SessionSecret)))
+	server.RegisterSessionRoutes(r, server.NewSessionStore([]byte(config.SessionSecret)))
+	redirectConfig := server.RedirectConfig{HTTPPort: config.Port}
 	if !config.DisableTLS {
-		server.RegisterX509Routes(r, config.ServerCertificateFile, config.ServerPrivateKeyFile)
+		redirectConfig.HTTPSPort = config.PortTLS
 	}
-	server.RegisterStaticHandler(r)
-	return r
+	server.RegisterRedirectRoutes(r, redirectConfig)
+	server.RegisterFormRoutes(r, config.Forms)
+	server.RegisterAuthRoutes(r, config.AuthUsers)
+	r.HandleFunc("/metrics", metrics.Handler)
+	if !config.DisableTLS {
+		if config.TLSInspection {
+			r.HandleFunc("/tls/clients", tlsClients.clientsHandler)
+			r.HandleFunc("/tls/stats", tlsClients.statsHandler)
+		}
+		server.RegisterX509Routes(r, certificates.CACertPEM, certificates.CAKeyPEM, server.ACMEConfig{
+			ChallengeMode: config.ACMEChallenge,
+			HTTP01Port:    config.ACMEHTTP01Port,
+		})
+	}
+	server.RegisterStaticHandler(r, server.EchoConfig{MaxBodySize: config.EchoMaxBodySize})
+
+	// wrapping the router, so the access log reports the resolved client and
+	// requests not matching any route are counted as well
+	handler := server.NewForwardedMiddleware(config.TrustedProxies)(r)
+	handler = server.NewConnectionMiddleware(config.MaxRequestsPerConn)(handler)
+	if config.AccessLog {
+		return handlers.CombinedLoggingHandler(os.Stdout, handler)
+	}
+	return handler
 }
 
 func provideHttpServer(handler http.Handler, config testAppConfig) *http.Server {
@@ -149,18 +475,26 @@ func provideHttpServer(handler http.Handler, config testAppConfig) *http.Server
 		Addr:         ":" + config.Port,
 		WriteTimeout: config.HttpWriteTimeout,
 		ReadTimeout:  config.HttpReadTimeout,
+		IdleTimeout:  config.HttpIdleTimeout,
+		ConnContext:  conninfo.ConnContext,
 	}
 }
 
-func provideHttpsServer(handler http.Handler, config testAppConfig) *http.Server {
-	return &http.Server{
+func provideHttpsServer(handler http.Handler, config testAppConfig, certStore *tlsutil.CertStore) *http.Server {
+	s := &http.Server{
 		Handler:      handler,
 		Addr:         ":" + config.PortTLS,
 		WriteTimeout: config.HttpWriteTimeout,
 		ReadTimeout:  config.HttpReadTimeout,
+		IdleTimeout:  config.HttpIdleTimeout,
+		ConnContext:  conninfo.ConnContext,
 		TLSConfig: &tls.Config{
+			GetCertificate:     certStore.GetCertificate,
 			InsecureSkipVerify: true,
 			ClientAuth:         tls.RequestClientCert,
 		},
 	}
+	config.TLS.apply(s)
+
+	return s
 }
@@ -0,0 +1,967 @@
+package server
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/stormforger/testapp/internal/pki"
+)
+
+// ACMEConfig configures the ACME (RFC 8555) endpoints.
+type ACMEConfig struct {
+	// ChallengeMode is "auto" to approve every challenge or "http-01" to
+	// validate challenges against the HTTP-01 responder of the client.
+	ChallengeMode string
+	// HTTP01Port is the port HTTP-01 validation requests are sent to.
+	HTTP01Port string
+	// ObjectTTL is the lifetime of orders and how long unused accounts are
+	// kept, zero meaning one hour.
+	ObjectTTL time.Duration
+}
+
+const (
+	acmePrefix        = "/acme"
+	acmeDefaultTTL    = time.Hour
+	acmeMaxNonces     = 100_000
+	acmeCertValidity  = 24 * time.Hour
+	acmeMaxBodyLength = 1 << 20
+)
+
+type acmeServer struct {
+	x509Handlers
+	config ACMEConfig
+	client *http.Client
+
+	mu             sync.Mutex
+	nonces         map[string]struct{}
+	accounts       map[string]*acmeAccount
+	accountsByKey  map[string]*acmeAccount
+	orders         map[string]*acmeOrder
+	authorizations map[string]*acmeAuthorization
+	challenges     map[string]*acmeChallenge
+	certificates   map[string][]byte
+	lastPrune      time.Time
+}
+
+type acmeIdentifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+type acmeAccount struct {
+	ID         string
+	Key        jsonWebKey
+	Thumbprint string
+	PublicKey  crypto.PublicKey
+	Status     string
+	Contact    []string
+	LastUsed   time.Time
+}
+
+type acmeOrder struct {
+	ID               string
+	AccountID        string
+	Status           string
+	Expires          time.Time
+	Identifiers      []acmeIdentifier
+	AuthorizationIDs []string
+	CertificateID    string
+	Error            *acmeProblem
+}
+
+type acmeAuthorization struct {
+	ID           string
+	AccountID    string
+	OrderID      string
+	Identifier   acmeIdentifier
+	Status       string
+	Expires      time.Time
+	ChallengeIDs []string
+}
+
+type acmeChallenge struct {
+	ID              string
+	AuthorizationID string
+	Type            string
+	Token           string
+	Status          string
+	Validated       time.Time
+	Error           *acmeProblem
+}
+
+// acmeRequest is an authenticated ACME POST request.
+type acmeRequest struct {
+	Payload []byte
+	// Account is set for requests signed with a known account key (kid).
+	Account *acmeAccount
+	// JWK is set for requests carrying their public key (jwk).
+	JWK       *jsonWebKey
+	PublicKey crypto.PublicKey
+}
+
+// RegisterACMEHandlers installs a minimal ACME server below /acme, issuing
+// certificates with the given CA certificate and key.
+func RegisterACMEHandlers(router *mux.Router, caCertPEMData, caPrivateKeyPEMData []byte, config ACMEConfig) error {
+	x, err := buildX509Handlers(caCertPEMData, caPrivateKeyPEMData)
+	if err != nil {
+		return err
+	}
+	if config.ChallengeMode != "auto" && config.ChallengeMode != "http-01" {
+		return fmt.Errorf("unsupported ACME challenge mode %q", config.ChallengeMode)
+	}
+	if config.ObjectTTL <= 0 {
+		config.ObjectTTL = acmeDefaultTTL
+	}
+
+	a := &acmeServer{
+		x509Handlers:   x,
+		config:         config,
+		client:         &http.Client{Timeout: 10 * time.Second},
+		nonces:         map[string]struct{}{},
+		accounts:       map[string]*acmeAccount{},
+		accountsByKey:  map[string]*acmeAccount{},
+		orders:         map[string]*acmeOrder{},
+		authorizations: map[string]*acmeAuthorization{},
+		challenges:     map[string]*acmeChallenge{},
+		certificates:   map[string][]byte{},
+		lastPrune:      time.Now(),
+	}
+
+	s := router.PathPrefix(acmePrefix).Subrouter()
+	s.HandleFunc("/directory", a.directoryHandler).Methods("GET")
+	s.HandleFunc("/new-nonce", a.newNonceHandler).Methods("GET", "HEAD")
+	s.HandleFunc("/new-account", a.newAccountHandler).Methods("POST")
+	s.HandleFunc("/account/{id}", a.accountHandler).Methods("POST")
+	s.HandleFunc("/account/{id}/orders", a.accountOrdersHandler).Methods("POST")
+	s.HandleFunc("/new-order", a.newOrderHandler).Methods("POST")
+	s.HandleFunc("/order/{id}", a.orderHandler).Methods("POST")
+	s.HandleFunc("/authz/{id}", a.authorizationHandler).Methods("POST")
+	s.HandleFunc("/chall/{id}", a.challengeHandler).Methods("POST")
+	s.HandleFunc("/finalize/{id}", a.finalizeHandler).Methods("POST")
+	s.HandleFunc("/cert/{id}", a.certificateHandler).Methods("POST")
+
+	return nil
+}
+
+func (a *acmeServer) directoryHandler(w http.ResponseWriter, r *http.Request) {
+	base := acmeBaseURL(r)
+	a.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"newNonce":   base + "/new-nonce",
+		"newAccount": base + "/new-account",
+		"newOrder":   base + "/new-order",
+		"meta": map[string]interface{}{
+			"externalAccountRequired": false,
+		},
+	})
+}
+
+func (a *acmeServer) newNonceHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", a.newNonce())
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Link", fmt.Sprintf("<%s/directory>;rel=\"index\"", acmeBaseURL(r)))
+
+	if r.Method == http.MethodGet {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (a *acmeServer) newAccountHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := a.parseRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.JWK == nil {
+		a.writeProblem(w, r, http.StatusBadRequest, "malformed", "newAccount requests must carry a jwk")
+		return
+	}
+
+	var payload struct {
+		Contact              []string `json:"contact"`
+		TermsOfServiceAgreed bool     `json:"termsOfServiceAgreed"`
+		OnlyReturnExisting   bool     `json:"onlyReturnExisting"`
+	}
+	if err := json.Unmarshal(req.Payload, &payload); err != nil {
+		a.writeProblem(w, r, http.StatusBadRequest, "malformed", "invalid payload: "+err.Error())
+		return
+	}
+
+	thumbprint := req.JWK.Thumbprint()
+
+	a.mu.Lock()
+	a.pruneLocked()
+	account, exists := a.accountsByKey[thumbprint]
+	status := http.StatusOK
+	if !exists {
+		if payload.OnlyReturnExisting {
+			a.mu.Unlock()
+			a.writeProblem(w, r, http.StatusBadRequest, "accountDoesNotExist", "no account exists for this key")
+			return
+		}
+
+		account = &acmeAccount{
+			ID:         acmeRandomID(),
+			Key:        *req.JWK,
+			Thumbprint: thumbprint,
+			PublicKey:  req.PublicKey,
+			Status:     "valid",
+			Contact:    payload.Contact,
+		}
+		a.accounts[account.ID] = account
+		a.accountsByKey[thumbprint] = account
+		status = http.StatusCreated
+	}
+	account.LastUsed = time.Now()
+	resource := a.accountResource(r, account)
+	a.mu.Unlock()
+
+	w.Header().Set("Location", acmeBaseURL(r)+"/account/"+account.ID)
+	a.writeJSON(w, r, status, resource)
+}
+
+func (a *acmeServer) accountHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := a.parseAccountRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.Account.ID != mux.Vars(r)["id"] {
+		a.writeProblem(w, r, http.StatusForbidden, "unauthorized", "account does not match key")
+		return
+	}
+
+	var payload struct {
+		Contact []string `json:"contact"`
+		Status  string   `json:"status"`
+	}
+	if len(req.Payload) > 0 {
+		if err := json.Unmarshal(req.Payload, &payload); err != nil {
+			a.writeProblem(w, r, http.StatusBadRequest, "malformed", "invalid payload: "+err.Error())
+			return
+		}
+	}
+
+	a.mu.Lock()
+	if payload.Contact != nil {
+		req.Account.Contact = payload.Contact
+	}
+	if payload.Status == "deactivated" {
+		req.Account.Status = "deactivated"
+	}
+	resource := a.accountResource(r, req.Account)
+	a.mu.Unlock()
+
+	a.writeJSON(w, r, http.StatusOK, resource)
+}
+
+func (a *acmeServer) accountOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := a.parseAccountRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.Account.ID != mux.Vars(r)["id"] {
+		a.writeProblem(w, r, http.StatusForbidden, "unauthorized", "account does not match key")
+		return
+	}
+
+	base := acmeBaseURL(r)
+	orders := []string{}
+
+	a.mu.Lock()
+	for _, o := range a.orders {
+		if o.AccountID == req.Account.ID {
+			orders = append(orders, base+"/order/"+o.ID)
+		}
+	}
+	a.mu.Unlock()
+	sort.Strings(orders)
+
+	a.writeJSON(w, r, http.StatusOK, map[string]interface{}{"orders": orders})
+}
+
+func (a *acmeServer) newOrderHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := a.parseAccountRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var payload struct {
+		Identifiers []acmeIdentifier `json:"identifiers"`
+	}
+	if err := json.Unmarshal(req.Payload, &payload); err != nil {
+		a.writeProblem(w, r, http.StatusBadRequest, "malformed", "invalid payload: "+err.Error())
+		return
+	}
+	if len(payload.Identifiers) == 0 {
+		a.writeProblem(w, r, http.StatusBadRequest, "malformed", "no identifiers requested")
+		return
+	}
+	for _, id := range payload.Identifiers {
+		if id.Type != "dns" {
+			a.writeProblem(w, r, http.StatusBadRequest, "unsupportedIdentifier", fmt.Sprintf("identifier type %q is not supported", id.Type))
+			return
+		}
+		if id.Value == "" || strings.HasPrefix(id.Value, "*.") {
+			a.writeProblem(w, r, http.StatusBadRequest, "rejectedIdentifier", fmt.Sprintf("identifier %q is not supported", id.Value))
+			return
+		}
+	}
+
+	expires := time.Now().Add(a.config.ObjectTTL)
+	order := &acmeOrder{
+		ID:          acmeRandomID(),
+		AccountID:   req.Account.ID,
+		Status:      "pending",
+		Expires:     expires,
+		Identifiers: payload.Identifiers,
+	}
+
+	a.mu.Lock()
+	a.pruneLocked()
+	for _, id := range payload.Identifiers {
+		authz := &acmeAuthorization{
+			ID:         acmeRandomID(),
+			AccountID:  req.Account.ID,
+			OrderID:    order.ID,
+			Identifier: id,
+			Status:     "pending",
+			Expires:    expires,
+		}
+		challenge := &acmeChallenge{
+			ID:              acmeRandomID(),
+			AuthorizationID: authz.ID,
+			Type:            "http-01",
+			Token:           acmeRandomID(),
+			Status:          "pending",
+		}
+		authz.ChallengeIDs = []string{challenge.ID}
+		order.AuthorizationIDs = append(order.AuthorizationIDs, authz.ID)
+
+		a.authorizations[authz.ID] = authz
+		a.challenges[challenge.ID] = challenge
+	}
+	a.orders[order.ID] = order
+	resource := a.orderResource(r, order)
+	a.mu.Unlock()
+
+	w.Header().Set("Location", acmeBaseURL(r)+"/order/"+order.ID)
+	a.writeJSON(w, r, http.StatusCreated, resource)
+}
+
+func (a *acmeServer) orderHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := a.parseAccountRequest(w, r)
+	if !ok {
+		return
+	}
+
+	a.mu.Lock()
+	order, exists := a.orders[mux.Vars(r)["id"]]
+	if !exists || order.AccountID != req.Account.ID {
+		a.mu.Unlock()
+		a.writeProblem(w, r, http.StatusNotFound, "malformed", "order not found")
+		return
+	}
+	resource := a.orderResource(r, order)
+	a.mu.Unlock()
+
+	a.writeJSON(w, r, http.StatusOK, resource)
+}
+
+func (a *acmeServer) authorizationHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := a.parseAccountRequest(w, r)
+	if !ok {
+		return
+	}
+
+	a.mu.Lock()
+	authz, exists := a.authorizations[mux.Vars(r)["id"]]
+	if !exists || authz.AccountID != req.Account.ID {
+		a.mu.Unlock()
+		a.writeProblem(w, r, http.StatusNotFound, "malformed", "authorization not found")
+		return
+	}
+	resource := a.authorizationResource(r, authz)
+	a.mu.Unlock()
+
+	a.writeJSON(w, r, http.StatusOK, resource)
+}
+
+func (a *acmeServer) challengeHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := a.parseAccountRequest(w, r)
+	if !ok {
+		return
+	}
+
+	a.mu.Lock()
+	challenge, exists := a.challenges[mux.Vars(r)["id"]]
+	var authz *acmeAuthorization
+	if exists {
+		authz = a.authorizations[challenge.AuthorizationID]
+	}
+	if authz == nil || authz.AccountID != req.Account.ID {
+		a.mu.Unlock()
+		a.writeProblem(w, r, http.StatusNotFound, "malformed", "challenge not found")
+		return
+	}
+
+	// an empty JSON object starts the validation, POST-as-GET only returns
+	// the current state
+	if len(req.Payload) > 0 && challenge.Status == "pending" {
+		challenge.Status = "processing"
+
+		if a.config.ChallengeMode == "auto" {
+			a.completeChallengeLocked(challenge, nil)
+		} else {
+			keyAuthorization := challenge.Token + "." + req.Account.Key.Thumbprint()
+			go a.validateHTTP01(challenge.ID, authz.Identifier.Value, challenge.Token, keyAuthorization)
+		}
+	}
+	resource := a.challengeResource(r, challenge)
+	a.mu.Unlock()
+
+	w.Header().Add("Link", fmt.Sprintf("<%s/authz/%s>;rel=\"up\"", acmeBaseURL(r), authz.ID))
+	a.writeJSON(w, r, http.StatusOK, resource)
+}
+
+// validateHTTP01 fetches the key authorization from the HTTP-01 responder of
+// domain (RFC 8555 8.3) and completes the challenge accordingly.
+func (a *acmeServer) validateHTTP01(challengeID, domain, token, keyAuthorization string) {
+	url := fmt.Sprintf("http://%s/.well-known/acme-challenge/%s", net.JoinHostPort(domain, a.config.HTTP01Port), token)
+
+	var problem *acmeProblem
+	resp, err := a.client.Get(url)
+	if err != nil {
+		problem = &acmeProblem{Type: "urn:ietf:params:acme:error:connection", Detail: err.Error(), Status: http.StatusBadRequest}
+	} else {
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+
+		switch {
+		case err != nil:
+			problem = &acmeProblem{Type: "urn:ietf:params:acme:error:connection", Detail: err.Error(), Status: http.StatusBadRequest}
+		case resp.StatusCode != http.StatusOK:
+			problem = &acmeProblem{Type: "urn:ietf:params:acme:error:unauthorized", Detail: fmt.Sprintf("%s responded with status %d", url, resp.StatusCode), Status: http.StatusForbidden}
+		case strings.TrimSpace(string(body)) != keyAuthorization:
+			problem = &acmeProblem{Type: "urn:ietf:params:acme:error:unauthorized", Detail: fmt.Sprintf("%s responded with an invalid key authorization", url), Status: http.StatusForbidden}
+		}
+	}
+
+	if problem != nil {
+		logrus.Infof("acme: http-01 validation of %s failed: %s", domain, problem.Detail)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if challenge, exists := a.challenges[challengeID]; exists {
+		a.completeChallengeLocked(challenge, problem)
+	}
+}
+
+// completeChallengeLocked marks the challenge and its authorization as valid,
+// or as invalid if problem is set, and updates the order accordingly.
+func (a *acmeServer) completeChallengeLocked(challenge *acmeChallenge, problem *acmeProblem) {
+	authz := a.authorizations[challenge.AuthorizationID]
+
+	if problem == nil {
+		challenge.Status = "valid"
+		challenge.Validated = time.Now()
+		authz.Status = "valid"
+	} else {
+		challenge.Status = "invalid"
+		challenge.Error = problem
+		authz.Status = "invalid"
+	}
+
+	order, exists := a.orders[authz.OrderID]
+	if !exists || order.Status != "pending" {
+		return
+	}
+
+	ready := true
+	for _, id := range order.AuthorizationIDs {
+		switch a.authorizations[id].Status {
+		case "invalid":
+			order.Status = "invalid"
+			order.Error = problem
+		case "valid":
+		default:
+			ready = false
+		}
+	}
+	if order.Status == "pending" && ready {
+		order.Status = "ready"
+	}
+}
+
+func (a *acmeServer) finalizeHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := a.parseAccountRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var payload struct {
+		CSR string `json:"csr"`
+	}
+	if err := json.Unmarshal(req.Payload, &payload); err != nil {
+		a.writeProblem(w, r, http.StatusBadRequest, "malformed", "invalid payload: "+err.Error())
+		return
+	}
+	der, err := base64.RawURLEncoding.DecodeString(payload.CSR)
+	if err != nil {
+		a.writeProblem(w, r, http.StatusBadRequest, "badCSR", "csr is not base64url encoded")
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		a.writeProblem(w, r, http.StatusBadRequest, "badCSR", "could not parse CSR: "+err.Error())
+		return
+	}
+	if err := csr.CheckSignature(); err != nil {
+		a.writeProblem(w, r, http.StatusBadRequest, "badCSR", "invalid CSR signature")
+		return
+	}
+
+	a.mu.Lock()
+	order, exists := a.orders[mux.Vars(r)["id"]]
+	if !exists || order.AccountID != req.Account.ID {
+		a.mu.Unlock()
+		a.writeProblem(w, r, http.StatusNotFound, "malformed", "order not found")
+		return
+	}
+	if time.Now().After(order.Expires) && order.Status != "valid" {
+		order.Status = "invalid"
+		order.Error = &acmeProblem{Type: "urn:ietf:params:acme:error:malformed", Detail: "order has expired", Status: http.StatusForbidden}
+	}
+	if order.Status != "ready" {
+		a.mu.Unlock()
+		a.writeProblem(w, r, http.StatusForbidden, "orderNotReady", fmt.Sprintf("order is %s", order.Status))
+		return
+	}
+
+	names := csrNames(csr)
+	if !sameNames(names, order.Identifiers) {
+		a.mu.Unlock()
+		a.writeProblem(w, r, http.StatusBadRequest, "badCSR", "CSR names do not match the order identifiers")
+		return
+	}
+
+	chain, err := a.issueCertificate(csr, names)
+	if err != nil {
+		order.Status = "invalid"
+		order.Error = &acmeProblem{Type: "urn:ietf:params:acme:error:serverInternal", Detail: err.Error(), Status: http.StatusInternalServerError}
+		a.mu.Unlock()
+		a.writeProblem(w, r, http.StatusInternalServerError, "serverInternal", "could not issue certificate")
+		logrus.Errorf("acme: issuing certificate: %v", err)
+		return
+	}
+
+	order.CertificateID = acmeRandomID()
+	order.Status = "valid"
+	a.certificates[order.CertificateID] = chain
+	resource := a.orderResource(r, order)
+	a.mu.Unlock()
+
+	w.Header().Set("Location", acmeBaseURL(r)+"/order/"+order.ID)
+	a.writeJSON(w, r, http.StatusOK, resource)
+}
+
+// issueCertificate signs a server certificate for names and returns the PEM
+// encoded chain.
+func (a *acmeServer) issueCertificate(csr *x509.CertificateRequest, names []string) ([]byte, error) {
+	now := time.Now()
+	notAfter := now.Add(acmeCertValidity)
+	if notAfter.After(a.CACert.NotAfter) {
+		notAfter = a.CACert.NotAfter
+	}
+
+	template := pki.LeafTemplate(names, now.Add(-5*time.Minute), notAfter)
+	template.ExtKeyUsage = append(template.ExtKeyUsage, x509.ExtKeyUsageClientAuth)
+
+	raw, err := x509.CreateCertificate(rand.Reader, template, a.CACert, csr.PublicKey, a.CAPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(pki.EncodeCertificates(cert), a.CACertPEMData...), nil
+}
+
+func (a *acmeServer) certificateHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := a.parseAccountRequest(w, r)
+	if !ok {
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+
+	a.mu.Lock()
+	chain, exists := a.certificates[id]
+	owned := false
+	for _, o := range a.orders {
+		if o.CertificateID == id && o.AccountID == req.Account.ID {
+			owned = true
+			break
+		}
+	}
+	a.mu.Unlock()
+
+	if !exists || !owned {
+		a.writeProblem(w, r, http.StatusNotFound, "malformed", "certificate not found")
+		return
+	}
+
+	a.setResponseHeaders(w, r)
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	w.Write(chain)
+}
+
+// parseAccountRequest parses a request that must be signed by an existing,
+// valid account.
+func (a *acmeServer) parseAccountRequest(w http.ResponseWriter, r *http.Request) (*acmeRequest, bool) {
+	req, ok := a.parseRequest(w, r)
+	if !ok {
+		return nil, false
+	}
+	if req.Account == nil {
+		a.writeProblem(w, r, http.StatusBadRequest, "malformed", "request must be signed with an account key (kid)")
+		return nil, false
+	}
+
+	return req, true
+}
+
+// parseRequest verifies the JWS of an ACME POST request (RFC 8555 6.2-6.5).
+func (a *acmeServer) parseRequest(w http.ResponseWriter, r *http.Request) (*acmeRequest, bool) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, acmeMaxBodyLength))
+	if err != nil {
+		a.writeProblem(w, r, http.StatusBadRequest, "malformed", "could not read body")
+		return nil, false
+	}
+
+	var msg jwsMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		a.writeProblem(w, r, http.StatusBadRequest, "malformed", "body is not a flattened JWS")
+		return nil, false
+	}
+
+	protected, err := base64.RawURLEncoding.DecodeString(msg.Protected)
+	if err != nil {
+		a.writeProblem(w, r, http.StatusBadRequest, "malformed", "protected header is not base64url encoded")
+		return nil, false
+	}
+	var header jwsHeader
+	if err := json.Unmarshal(protected, &header); err != nil {
+		a.writeProblem(w, r, http.StatusBadRequest, "malformed", "invalid protected header")
+		return nil, false
+	}
+
+	if !a.useNonce(header.Nonce) {
+		a.writeProblem(w, r, http.StatusBadRequest, "badNonce", "invalid or reused nonce")
+		return nil, false
+	}
+
+	if header.URL != AbsoluteURL(r, r.URL.RequestURI()) {
+		a.writeProblem(w, r, http.StatusUnauthorized, "unauthorized", "url header does not match request URL")
+		return nil, false
+	}
+
+	req := &acmeRequest{}
+	switch {
+	case len(header.JWK) > 0 && header.KeyID == "":
+		var jwk jsonWebKey
+		if err := json.Unmarshal(header.JWK, &jwk); err != nil {
+			a.writeProblem(w, r, http.StatusBadRequest, "malformed", "invalid jwk")
+			return nil, false
+		}
+		pub, err := jwk.PublicKey()
+		if err != nil {
+			a.writeProblem(w, r, http.StatusBadRequest, "badPublicKey", err.Error())
+			return nil, false
+		}
+		req.JWK = &jwk
+		req.PublicKey = pub
+
+	case len(header.JWK) == 0 && header.KeyID != "":
+		id := header.KeyID[strings.LastIndex(header.KeyID, "/")+1:]
+
+		a.mu.Lock()
+		account, exists := a.accounts[id]
+		var status string
+		if exists {
+			status = account.Status
+			account.LastUsed = time.Now()
+		}
+		a.mu.Unlock()
+
+		if !exists {
+			a.writeProblem(w, r, http.StatusBadRequest, "accountDoesNotExist", "unknown account")
+			return nil, false
+		}
+		if status != "valid" {
+			a.writeProblem(w, r, http.StatusUnauthorized, "unauthorized", "account is "+status)
+			return nil, false
+		}
+		req.Account = account
+		req.PublicKey = account.PublicKey
+
+	default:
+		a.writeProblem(w, r, http.StatusBadRequest, "malformed", "exactly one of jwk and kid is required")
+		return nil, false
+	}
+
+	if err := verifyJWS(msg, header.Algorithm, req.PublicKey); err != nil {
+		a.writeProblem(w, r, http.StatusBadRequest, "badSignatureAlgorithm", "signature verification failed: "+err.Error())
+		return nil, false
+	}
+
+	req.Payload, err = base64.RawURLEncoding.DecodeString(msg.Payload)
+	if err != nil {
+		a.writeProblem(w, r, http.StatusBadRequest, "malformed", "payload is not base64url encoded")
+		return nil, false
+	}
+
+	return req, true
+}
+
+func (a *acmeServer) newNonce() string {
+	nonce := acmeRandomID()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.nonces) >= acmeMaxNonces {
+		// clients are expected to retry on badNonce errors
+		a.nonces = map[string]struct{}{}
+	}
+	a.nonces[nonce] = struct{}{}
+
+	return nonce
+}
+
+func (a *acmeServer) useNonce(nonce string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	_, exists := a.nonces[nonce]
+	delete(a.nonces, nonce)
+
+	return exists
+}
+
+// pruneLocked removes orders and the objects belonging to them once they
+// have been expired for a while, and accounts not used for as long.
+func (a *acmeServer) pruneLocked() {
+	now := time.Now()
+	if now.Sub(a.lastPrune) < time.Minute {
+		return
+	}
+	a.lastPrune = now
+
+	for id, account := range a.accounts {
+		if now.Sub(account.LastUsed) >= a.config.ObjectTTL {
+			delete(a.accountsByKey, account.Thumbprint)
+			delete(a.accounts, id)
+		}
+	}
+
+	for id, order := range a.orders {
+		if now.Sub(order.Expires) < a.config.ObjectTTL {
+			continue
+		}
+
+		for _, authzID := range order.AuthorizationIDs {
+			if authz, exists := a.authorizations[authzID]; exists {
+				for _, challengeID := range authz.ChallengeIDs {
+					delete(a.challenges, challengeID)
+				}
+			}
+			delete(a.authorizations, authzID)
+		}
+		delete(a.certificates, order.CertificateID)
+		delete(a.orders, id)
+	}
+}
+
+func (a *acmeServer) setResponseHeaders(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", a.newNonce())
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Add("Link", fmt.Sprintf("<%s/directory>;rel=\"index\"", acmeBaseURL(r)))
+}
+
+func (a *acmeServer) writeJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	a.setResponseHeaders(w, r)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	if err := e.Encode(v); err != nil {
+		logrus.Errorf("json marshal: %v", err)
+	}
+}
+
+func (a *acmeServer) writeProblem(w http.ResponseWriter, r *http.Request, status int, errorType, detail string) {
+	a.setResponseHeaders(w, r)
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	e.Encode(acmeProblem{
+		Type:   "urn:ietf:params:acme:error:" + errorType,
+		Detail: detail,
+		Status: status,
+	})
+}
+
+func (a *acmeServer) accountResource(r *http.Request, account *acmeAccount) interface{} {
+	return struct {
+		Status  string   `json:"status"`
+		Contact []string `json:"contact,omitempty"`
+		Orders  string   `json:"orders"`
+	}{
+		Status:  account.Status,
+		Contact: account.Contact,
+		Orders:  acmeBaseURL(r) + "/account/" + account.ID + "/orders",
+	}
+}
+
+func (a *acmeServer) orderResource(r *http.Request, order *acmeOrder) interface{} {
+	base := acmeBaseURL(r)
+
+	resource := struct {
+		Status         string           `json:"status"`
+		Expires        string           `json:"expires"`
+		Identifiers    []acmeIdentifier `json:"identifiers"`
+		Authorizations []string         `json:"authorizations"`
+		Finalize       string           `json:"finalize"`
+		Certificate    string           `json:"certificate,omitempty"`
+		Error          *acmeProblem     `json:"error,omitempty"`
+	}{
+		Status:      order.Status,
+		Expires:     order.Expires.UTC().Format(time.RFC3339),
+		Identifiers: order.Identifiers,
+		Finalize:    base + "/finalize/" + order.ID,
+		Error:       order.Error,
+	}
+	for _, id := range order.AuthorizationIDs {
+		resource.Authorizations = append(resource.Authorizations, base+"/authz/"+id)
+	}
+	if order.CertificateID != "" {
+		resource.Certificate = base + "/cert/" + order.CertificateID
+	}
+
+	return resource
+}
+
+func (a *acmeServer) authorizationResource(r *http.Request, authz *acmeAuthorization) interface{} {
+	resource := struct {
+		Status     string         `json:"status"`
+		Expires    string         `json:"expires"`
+		Identifier acmeIdentifier `json:"identifier"`
+		Challenges []interface{}  `json:"challenges"`
+	}{
+		Status:     authz.Status,
+		Expires:    authz.Expires.UTC().Format(time.RFC3339),
+		Identifier: authz.Identifier,
+	}
+	for _, id := range authz.ChallengeIDs {
+		resource.Challenges = append(resource.Challenges, a.challengeResource(r, a.challenges[id]))
+	}
+
+	return resource
+}
+
+func (a *acmeServer) challengeResource(r *http.Request, challenge *acmeChallenge) interface{} {
+	resource := struct {
+		Type      string       `json:"type"`
+		URL       string       `json:"url"`
+		Token     string       `json:"token"`
+		Status    string       `json:"status"`
+		Validated string       `json:"validated,omitempty"`
+		Error     *acmeProblem `json:"error,omitempty"`
+	}{
+		Type:   challenge.Type,
+		URL:    acmeBaseURL(r) + "/chall/" + challenge.ID,
+		Token:  challenge.Token,
+		Status: challenge.Status,
+		Error:  challenge.Error,
+	}
+	if !challenge.Validated.IsZero() {
+		resource.Validated = challenge.Validated.UTC().Format(time.RFC3339)
+	}
+
+	return resource
+}
+
+// acmeBaseURL returns the absolute URL of the ACME endpoints as seen by the
+// client.
+func acmeBaseURL(r *http.Request) string {
+	return AbsoluteURL(r, acmePrefix)
+}
+
+// acmeRandomID returns a random base64url encoded 128 bit value, suitable
+// for nonces, tokens and object IDs.
+func acmeRandomID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// csrNames returns the deduplicated DNS names requested by csr, including
+// its common name.
+func csrNames(csr *x509.CertificateRequest) []string {
+	seen := map[string]bool{}
+	var names []string
+	for _, n := range append([]string{csr.Subject.CommonName}, csr.DNSNames...) {
+		n = strings.ToLower(n)
+		if n != "" && !seen[n] {
+			seen[n] = true
+			names = append(names, n)
+		}
+	}
+
+	return names
+}
+
+func sameNames(names []string, identifiers []acmeIdentifier) bool {
+	expected := map[string]bool{}
+	for _, id := range identifiers {
+		expected[strings.ToLower(id.Value)] = true
+	}
+	if len(expected) != len(names) {
+		return false
+	}
+	for _, n := range names {
+		if !expected[n] {
+			return false
+		}
+	}
+
+	return true
+}
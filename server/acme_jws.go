@@ -0,0 +1,187 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+)
+
+// jwsMessage is a JWS in flattened JSON serialization (RFC 7515 7.2.2), as
+// required by RFC 8555 6.2.
+type jwsMessage struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+type jwsHeader struct {
+	Algorithm string          `json:"alg"`
+	Nonce     string          `json:"nonce"`
+	URL       string          `json:"url"`
+	KeyID     string          `json:"kid,omitempty"`
+	JWK       json.RawMessage `json:"jwk,omitempty"`
+}
+
+// jsonWebKey holds the public key members of a JWK (RFC 7517) for the key
+// types supported by the ACME endpoints.
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	Curve   string `json:"crv,omitempty"`
+	N       string `json:"n,omitempty"`
+	E       string `json:"e,omitempty"`
+	X       string `json:"x,omitempty"`
+	Y       string `json:"y,omitempty"`
+}
+
+// PublicKey converts the JWK into a crypto.PublicKey.
+func (k jsonWebKey) PublicKey() (crypto.PublicKey, error) {
+	switch k.KeyType {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Curve)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("invalid EC point")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	case "OKP":
+		if k.Curve != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Curve)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.KeyType)
+	}
+}
+
+// Thumbprint returns the base64url encoded SHA-256 JWK thumbprint
+// (RFC 7638) of the key.
+func (k jsonWebKey) Thumbprint() string {
+	var members string
+	switch k.KeyType {
+	case "RSA":
+		members = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, k.E, k.N)
+	case "EC":
+		members = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, k.Curve, k.X, k.Y)
+	default:
+		members = fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q}`, k.Curve, k.KeyType, k.X)
+	}
+
+	sum := sha256.Sum256([]byte(members))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// verifyJWS checks the signature of msg with pub.
+func verifyJWS(msg jwsMessage, alg string, pub crypto.PublicKey) error {
+	signature, err := base64.RawURLEncoding.DecodeString(msg.Signature)
+	if err != nil {
+		return fmt.Errorf("signature: %v", err)
+	}
+	signingInput := []byte(msg.Protected + "." + msg.Payload)
+
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		if alg != "RS256" {
+			return fmt.Errorf("algorithm %s does not match RSA key", alg)
+		}
+		digest := sha256.Sum256(signingInput)
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature)
+
+	case *ecdsa.PublicKey:
+		var digest []byte
+		switch {
+		case alg == "ES256" && key.Curve == elliptic.P256():
+			sum := sha256.Sum256(signingInput)
+			digest = sum[:]
+		case alg == "ES384" && key.Curve == elliptic.P384():
+			sum := sha512.Sum384(signingInput)
+			digest = sum[:]
+		case alg == "ES512" && key.Curve == elliptic.P521():
+			sum := sha512.Sum512(signingInput)
+			digest = sum[:]
+		default:
+			return fmt.Errorf("algorithm %s does not match EC key", alg)
+		}
+
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return fmt.Errorf("invalid signature length")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+
+	case ed25519.PublicKey:
+		if alg != "EdDSA" {
+			return fmt.Errorf("algorithm %s does not match Ed25519 key", alg)
+		}
+		if !ed25519.Verify(key, signingInput, signature) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unsupported key %T", pub)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty integer")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,229 @@
+package server_test
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stormforger/testapp/internal/pki"
+	"github.com/stormforger/testapp/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// acmeTestClient is a bare bones ACME client signing requests with ES256.
+type acmeTestClient struct {
+	t     *testing.T
+	key   *ecdsa.PrivateKey
+	kid   string
+	nonce string
+}
+
+func (c *acmeTestClient) post(url string, payload interface{}) (*http.Response, []byte) {
+	return c.postSigned(url, url, payload)
+}
+
+// postSigned posts to url, signing headerURL as the url header.
+func (c *acmeTestClient) postSigned(url, headerURL string, payload interface{}) (*http.Response, []byte) {
+	header := map[string]interface{}{"alg": "ES256", "nonce": c.nonce, "url": headerURL}
+	if c.kid != "" {
+		header["kid"] = c.kid
+	} else {
+		header["jwk"] = map[string]string{
+			"kty": "EC",
+			"crv": "P-256",
+			"x":   base64.RawURLEncoding.EncodeToString(c.key.X.FillBytes(make([]byte, 32))),
+			"y":   base64.RawURLEncoding.EncodeToString(c.key.Y.FillBytes(make([]byte, 32))),
+		}
+	}
+
+	protectedJSON, _ := json.Marshal(header)
+	protected := base64.RawURLEncoding.EncodeToString(protectedJSON)
+	encodedPayload := ""
+	if payload != nil {
+		payloadJSON, _ := json.Marshal(payload)
+		encodedPayload = base64.RawURLEncoding.EncodeToString(payloadJSON)
+	}
+
+	digest := sha256.Sum256([]byte(protected + "." + encodedPayload))
+	r, s, err := ecdsa.Sign(rand.Reader, c.key, digest[:])
+	require.Nil(c.t, err)
+	signature := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+
+	body, _ := json.Marshal(map[string]string{
+		"protected": protected,
+		"payload":   encodedPayload,
+		"signature": base64.RawURLEncoding.EncodeToString(signature),
+	})
+
+	resp, err := http.Post(url, "application/jose+json", bytes.NewReader(body))
+	require.Nil(c.t, err)
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	require.Nil(c.t, err)
+
+	c.nonce = resp.Header.Get("Replay-Nonce")
+	return resp, data
+}
+
+// startACMEServer starts an ACME server and returns its directory and a client
+// with a fresh nonce.
+func startACMEServer(t *testing.T, config server.ACMEConfig) (*pki.Authority, map[string]interface{}, *acmeTestClient) {
+	ca, err := pki.NewAuthority("ACME test CA", pki.KeyTypeECDSA, time.Hour)
+	require.Nil(t, err)
+	caKeyPEM, err := pki.EncodePrivateKey(ca.Key)
+	require.Nil(t, err)
+
+	r := mux.NewRouter()
+	require.Nil(t, server.RegisterACMEHandlers(r, pki.EncodeCertificates(ca.Cert), caKeyPEM, config))
+	s := httptest.NewServer(r)
+	t.Cleanup(s.Close)
+
+	var directory map[string]interface{}
+	resp, err := http.Get(s.URL + "/acme/directory")
+	require.Nil(t, err)
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&directory))
+	resp.Body.Close()
+
+	resp, err = http.Head(directory["newNonce"].(string))
+	require.Nil(t, err)
+	resp.Body.Close()
+
+	accountKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	return ca, directory, &acmeTestClient{t: t, key: accountKey, nonce: resp.Header.Get("Replay-Nonce")}
+}
+
+func TestACMEIssuesCertificate(t *testing.T) {
+	ca, directory, c := startACMEServer(t, server.ACMEConfig{ChallengeMode: "auto"})
+
+	// replayed nonces are rejected
+	nonce := c.nonce
+	resp, _ := c.post(directory["newAccount"].(string), map[string]interface{}{"termsOfServiceAgreed": true})
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	c.kid = resp.Header.Get("Location")
+
+	c.nonce = nonce
+	resp, body := c.post(directory["newOrder"].(string), map[string]interface{}{})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Contains(t, string(body), "badNonce")
+
+	// the url header has to match the request URL exactly
+	resp, body = c.postSigned(directory["newOrder"].(string), "https://attacker.invalid/acme/new-order", map[string]interface{}{})
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Contains(t, string(body), "unauthorized")
+
+	var order struct {
+		Status         string   `json:"status"`
+		Authorizations []string `json:"authorizations"`
+		Finalize       string   `json:"finalize"`
+		Certificate    string   `json:"certificate"`
+	}
+	resp, body = c.post(directory["newOrder"].(string), map[string]interface{}{
+		"identifiers": []map[string]string{{"type": "dns", "value": "example.com"}},
+	})
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Nil(t, json.Unmarshal(body, &order))
+	orderURL := resp.Header.Get("Location")
+	assert.Equal(t, "pending", order.Status)
+	require.Len(t, order.Authorizations, 1)
+
+	var authz struct {
+		Challenges []struct {
+			URL string `json:"url"`
+		} `json:"challenges"`
+	}
+	_, body = c.post(order.Authorizations[0], nil)
+	require.Nil(t, json.Unmarshal(body, &authz))
+	require.Len(t, authz.Challenges, 1)
+
+	resp, body = c.post(authz.Challenges[0].URL, map[string]interface{}{})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(body), `"valid"`)
+
+	_, body = c.post(orderURL, nil)
+	require.Nil(t, json.Unmarshal(body, &order))
+	assert.Equal(t, "ready", order.Status)
+
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "example.com"},
+		DNSNames: []string{"example.com"},
+	}, crypto.Signer(certKey))
+	require.Nil(t, err)
+
+	resp, body = c.post(order.Finalize, map[string]string{"csr": base64.RawURLEncoding.EncodeToString(csr)})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Nil(t, json.Unmarshal(body, &order))
+	assert.Equal(t, "valid", order.Status)
+
+	resp, body = c.post(order.Certificate, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/pem-certificate-chain", resp.Header.Get("Content-Type"))
+
+	block, _ := pem.Decode(body)
+	require.NotNil(t, block)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	require.Nil(t, err)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	_, err = cert.Verify(x509.VerifyOptions{DNSName: "example.com", Roots: roots})
+	assert.Nil(t, err)
+}
+
+func TestACMEOrderExpires(t *testing.T) {
+	_, directory, c := startACMEServer(t, server.ACMEConfig{ChallengeMode: "auto", ObjectTTL: time.Second})
+
+	resp, _ := c.post(directory["newAccount"].(string), map[string]interface{}{"termsOfServiceAgreed": true})
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	c.kid = resp.Header.Get("Location")
+
+	var order struct {
+		Status         string   `json:"status"`
+		Authorizations []string `json:"authorizations"`
+		Finalize       string   `json:"finalize"`
+	}
+	resp, body := c.post(directory["newOrder"].(string), map[string]interface{}{
+		"identifiers": []map[string]string{{"type": "dns", "value": "example.com"}},
+	})
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Nil(t, json.Unmarshal(body, &order))
+
+	var authz struct {
+		Challenges []struct {
+			URL string `json:"url"`
+		} `json:"challenges"`
+	}
+	_, body = c.post(order.Authorizations[0], nil)
+	require.Nil(t, json.Unmarshal(body, &authz))
+	require.Len(t, authz.Challenges, 1)
+	resp, _ = c.post(authz.Challenges[0].URL, map[string]interface{}{})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{"example.com"}}, crypto.Signer(certKey))
+	require.Nil(t, err)
+
+	time.Sleep(1100 * time.Millisecond)
+	resp, body = c.post(order.Finalize, map[string]string{"csr": base64.RawURLEncoding.EncodeToString(csr)})
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Contains(t, string(body), "orderNotReady")
+	assert.Contains(t, string(body), "order is invalid")
+}
@@ -0,0 +1,372 @@
+package server
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	authRealm        = "testapp"
+	digestNonceTTL   = 5 * time.Minute
+	defaultAPIKeyHdr = "X-API-Key"
+)
+
+// AuthUsers maps user names to their password, which is also accepted as
+// bearer token and API key.
+type AuthUsers map[string]string
+
+// LoadAuthUsers reads `user:password` lines from the file at path. Empty
+// lines and lines starting with # are ignored. Passwords must be unique, as
+// bearer tokens and API keys identify the user.
+func LoadAuthUsers(path string) (AuthUsers, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := AuthUsers{}
+	passwords := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		user, password, found := strings.Cut(text, ":")
+		if !found || user == "" {
+			return nil, fmt.Errorf("%s:%d: expected user:password", path, line)
+		}
+		if other, exists := passwords[password]; exists && other != user {
+			return nil, fmt.Errorf("%s:%d: user %q has the same password as %q", path, line, user, other)
+		}
+		passwords[password] = user
+		users[user] = password
+	}
+	return users, scanner.Err()
+}
+
+// secret returns the user having secret as password.
+func (u AuthUsers) secret(secret string) (string, bool) {
+	for user, password := range u {
+		if secureCompare(password, secret) {
+			return user, true
+		}
+	}
+	return "", false
+}
+
+type authHandlers struct {
+	users    AuthUsers
+	nonceKey []byte
+	opaque   string
+}
+
+// RegisterAuthRoutes adds the /auth endpoints. Without credentials in the
+// path, the ones of users are checked.
+func RegisterAuthRoutes(r *mux.Router, users AuthUsers) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		logrus.Fatalf("generating digest nonce key: %v", err)
+	}
+	opaque := make([]byte, 16)
+	if _, err := rand.Read(opaque); err != nil {
+		logrus.Fatalf("generating digest opaque: %v", err)
+	}
+	a := &authHandlers{users: users, nonceKey: key, opaque: hex.EncodeToString(opaque)}
+
+	r.Path("/auth/basic/{user}/{password}").HandlerFunc(a.basicHandler)
+	r.Path("/auth/basic").HandlerFunc(a.basicHandler)
+	r.Path("/auth/digest/{qop}/{user}/{password}").HandlerFunc(a.digestHandler)
+	r.Path("/auth/digest/{qop}").HandlerFunc(a.digestHandler)
+	r.Path("/auth/bearer").HandlerFunc(a.bearerHandler)
+	r.Path("/auth/apikey").HandlerFunc(a.apiKeyHandler)
+}
+
+// password returns the expected password of user, from the path or the
+// configured users.
+func (a *authHandlers) password(r *http.Request, user string) (string, bool) {
+	vars := mux.Vars(r)
+	if expected, ok := vars["user"]; ok {
+		return vars["password"], secureCompare(expected, user)
+	}
+	password, ok := a.users[user]
+	return password, ok
+}
+
+// basicHandler validates HTTP Basic credentials (RFC 7617).
+func (a *authHandlers) basicHandler(w http.ResponseWriter, r *http.Request) {
+	user, password, ok := r.BasicAuth()
+	if ok {
+		expected, known := a.password(r, user)
+		if known && secureCompare(expected, password) {
+			writeAuthJSON(w, http.StatusOK, user, "")
+			return
+		}
+	}
+
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm=%q, charset="UTF-8"`, authRealm))
+	writeAuthJSON(w, http.StatusUnauthorized, "", "invalid or missing credentials")
+}
+
+// digestAlgorithms are the supported Digest algorithms (RFC 7616).
+var digestAlgorithms = map[string]func() hash.Hash{
+	"MD5":          md5.New,
+	"MD5-sess":     md5.New,
+	"SHA-256":      sha256.New,
+	"SHA-256-sess": sha256.New,
+}
+
+// digestHandler validates HTTP Digest credentials (RFC 7616) with the qop
+// `auth` or `auth-int` and the `algorithm` query parameter, MD5 by default.
+func (a *authHandlers) digestHandler(w http.ResponseWriter, r *http.Request) {
+	qop := mux.Vars(r)["qop"]
+	if qop != "auth" && qop != "auth-int" {
+		http.Error(w, "qop must be auth or auth-int", http.StatusBadRequest)
+		return
+	}
+	algorithm := r.URL.Query().Get("algorithm")
+	if algorithm == "" {
+		algorithm = "MD5"
+	}
+	newHash, ok := digestAlgorithms[algorithm]
+	if !ok {
+		http.Error(w, "algorithm must be MD5, MD5-sess, SHA-256 or SHA-256-sess", http.StatusBadRequest)
+		return
+	}
+
+	user, stale, err := a.validateDigest(r, qop, algorithm, newHash)
+	if err == nil {
+		writeAuthJSON(w, http.StatusOK, user, "")
+		return
+	}
+
+	challenge := fmt.Sprintf(`Digest realm=%q, qop=%q, algorithm=%s, nonce=%q, opaque=%q`,
+		authRealm, qop, algorithm, a.newNonce(), a.opaque)
+	if stale {
+		challenge += ", stale=true"
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	writeAuthJSON(w, http.StatusUnauthorized, "", err.Error())
+}
+
+// validateDigest returns the authenticated user, or whether the nonce is
+// stale and why the credentials are rejected.
+func (a *authHandlers) validateDigest(r *http.Request, qop, algorithm string, newHash func() hash.Hash) (string, bool, error) {
+	scheme, credentials, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Digest") {
+		return "", false, fmt.Errorf("missing credentials")
+	}
+	params := parseAuthParams(credentials)
+
+	switch {
+	case params["realm"] != authRealm:
+		return "", false, fmt.Errorf("wrong realm")
+	case params["opaque"] != a.opaque:
+		return "", false, fmt.Errorf("wrong opaque")
+	case params["qop"] != qop:
+		return "", false, fmt.Errorf("wrong qop")
+	case !strings.EqualFold(params["algorithm"], algorithm) && !(params["algorithm"] == "" && algorithm == "MD5"):
+		return "", false, fmt.Errorf("wrong algorithm")
+	case params["uri"] != r.RequestURI:
+		return "", false, fmt.Errorf("wrong uri")
+	}
+
+	valid, stale := a.checkNonce(params["nonce"])
+	if !valid {
+		return "", stale, fmt.Errorf("invalid nonce")
+	}
+
+	user := params["username"]
+	password, ok := a.password(r, user)
+	if !ok {
+		return "", false, fmt.Errorf("invalid or missing credentials")
+	}
+
+	h := func(s string) string {
+		hash := newHash()
+		io.WriteString(hash, s)
+		return hex.EncodeToString(hash.Sum(nil))
+	}
+
+	ha1 := h(user + ":" + authRealm + ":" + password)
+	if strings.HasSuffix(algorithm, "-sess") {
+		ha1 = h(ha1 + ":" + params["nonce"] + ":" + params["cnonce"])
+	}
+	ha2 := h(r.Method + ":" + params["uri"])
+	if qop == "auth-int" {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return "", false, fmt.Errorf("reading body: %w", err)
+		}
+		ha2 = h(r.Method + ":" + params["uri"] + ":" + h(string(body)))
+	}
+	expected := h(strings.Join([]string{ha1, params["nonce"], params["nc"], params["cnonce"], qop, ha2}, ":"))
+
+	if !secureCompare(expected, params["response"]) {
+		return "", false, fmt.Errorf("invalid or missing credentials")
+	}
+	return user, false, nil
+}
+
+// newNonce returns a nonce containing its creation time, signed to verify it
+// without keeping state.
+func (a *authHandlers) newNonce() string {
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint64(payload, uint64(time.Now().Unix()))
+	mac := hmac.New(sha256.New, a.nonceKey)
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(append(payload, mac.Sum(nil)...))
+}
+
+// checkNonce reports whether nonce was created by newNonce, and whether it
+// is older than digestNonceTTL.
+func (a *authHandlers) checkNonce(nonce string) (valid, stale bool) {
+	data, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(data) != 8+sha256.Size {
+		return false, false
+	}
+	mac := hmac.New(sha256.New, a.nonceKey)
+	mac.Write(data[:8])
+	if !hmac.Equal(data[8:], mac.Sum(nil)) {
+		return false, false
+	}
+
+	created := time.Unix(int64(binary.BigEndian.Uint64(data[:8])), 0)
+	if time.Since(created) > digestNonceTTL {
+		return false, true
+	}
+	return true, false
+}
+
+// parseAuthParams parses the comma separated `name=value` and
+// `name="value"` parameters of an Authorization header.
+func parseAuthParams(s string) map[string]string {
+	params := map[string]string{}
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " ,")
+		name, rest, found := strings.Cut(s, "=")
+		if !found {
+			break
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		rest = strings.TrimLeft(rest, " ")
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				b.WriteByte(rest[i])
+			}
+			if i < len(rest) {
+				i++
+			}
+			value, s = b.String(), rest[i:]
+		} else {
+			value, s, _ = strings.Cut(rest, ",")
+			value = strings.TrimSpace(value)
+		}
+		params[name] = value
+	}
+	return params
+}
+
+// bearerHandler validates a bearer token (RFC 6750), which has to match the
+// `token` query parameter or the password of a configured user. Without
+// either, every token is accepted.
+func (a *authHandlers) bearerHandler(w http.ResponseWriter, r *http.Request) {
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") || token == "" {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm=%q`, authRealm))
+		writeAuthJSON(w, http.StatusUnauthorized, "", "missing token")
+		return
+	}
+
+	user, ok := a.checkSecret(r, token)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm=%q, error="invalid_token"`, authRealm))
+		writeAuthJSON(w, http.StatusUnauthorized, "", "invalid token")
+		return
+	}
+	writeAuthJSON(w, http.StatusOK, user, "")
+}
+
+// apiKeyHandler validates an API key sent in the header named by the
+// `header` query parameter (default X-API-Key) or the `api_key` query
+// parameter. Like bearer tokens, it has to match the `token` query parameter
+// or the password of a configured user.
+func (a *authHandlers) apiKeyHandler(w http.ResponseWriter, r *http.Request) {
+	header := r.URL.Query().Get("header")
+	if header == "" {
+		header = defaultAPIKeyHdr
+	}
+	key := r.Header.Get(header)
+	if key == "" {
+		key = r.URL.Query().Get("api_key")
+	}
+	if key == "" {
+		writeAuthJSON(w, http.StatusUnauthorized, "", "missing API key")
+		return
+	}
+
+	user, ok := a.checkSecret(r, key)
+	if !ok {
+		writeAuthJSON(w, http.StatusUnauthorized, "", "invalid API key")
+		return
+	}
+	writeAuthJSON(w, http.StatusOK, user, "")
+}
+
+// checkSecret validates a bearer token or API key, returning the user it
+// belongs to if it is the password of a configured user.
+func (a *authHandlers) checkSecret(r *http.Request, secret string) (string, bool) {
+	if expected := r.URL.Query().Get("token"); expected != "" {
+		return "", secureCompare(expected, secret)
+	}
+	if len(a.users) > 0 {
+		return a.users.secret(secret)
+	}
+	return "", true
+}
+
+func secureCompare(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+type jsonAuth struct {
+	Authenticated bool   `json:"authenticated"`
+	User          string `json:"user,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+func writeAuthJSON(w http.ResponseWriter, status int, user, errorMessage string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	if err := e.Encode(jsonAuth{Authenticated: status == http.StatusOK, User: user, Error: errorMessage}); err != nil {
+		logrus.Errorf("json marshal: %v", err)
+	}
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// DefaultMaxBodySize is the default limit of NewRequestBodyMiddleware.
+const DefaultMaxBodySize = 100 << 20
+
+// Decompressed bodies may expand to at most maxExpansionRatio times the
+// received bytes plus maxExpansionSlack, regardless of the size limit, to
+// reject decompression bombs early.
+const (
+	maxExpansionRatio = 100
+	maxExpansionSlack = 1 << 20
+)
+
+// errBodyExpansion is returned when reading a decompressed body exceeding the
+// expansion ratio.
+var errBodyExpansion = fmt.Errorf("decompressed request body expands more than %d times", maxExpansionRatio)
+
+// RequestBody describes the request body as received, before decompression.
+type RequestBody struct {
+	// ContentEncoding is the Content-Encoding the body was sent with.
+	ContentEncoding string
+	received        atomic.Int64
+}
+
+// Received returns the number of bytes of the body read so far, compressed
+// if it was sent compressed.
+func (b *RequestBody) Received() int64 {
+	return b.received.Load()
+}
+
+type requestBodyContextKey struct{}
+
+// RequestBodyFromRequest returns the description of the body of r, stored by
+// the middleware of NewRequestBodyMiddleware, or nil.
+func RequestBodyFromRequest(r *http.Request) *RequestBody {
+	b, _ := r.Context().Value(requestBodyContextKey{}).(*RequestBody)
+	return b
+}
+
+// NewRequestBodyMiddleware decompresses request bodies sent with a gzip,
+// deflate, br or zstd Content-Encoding and limits bodies to maxSize bytes
+// before and after decompression, 0 meaning unlimited. Independent of
+// maxSize, the decompressed body may not expand more than maxExpansionRatio
+// times. Exceeding a limit is reported to handlers as *http.MaxBytesError or
+// errBodyExpansion, see writeBodyError.
+func NewRequestBodyMiddleware(maxSize int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if maxSize > 0 && r.ContentLength > maxSize {
+				http.Error(w, fmt.Sprintf("request body is larger than %d bytes", maxSize), http.StatusRequestEntityTooLarge)
+				return
+			}
+
+			info := &RequestBody{ContentEncoding: strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))}
+			ctx := context.WithValue(r.Context(), requestBodyContextKey{}, info)
+			if r.Body == nil || r.Body == http.NoBody {
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+
+			var body io.ReadCloser = &receivedCounter{ReadCloser: r.Body, info: info}
+			if maxSize > 0 {
+				body = http.MaxBytesReader(w, body, maxSize)
+			}
+
+			switch info.ContentEncoding {
+			case "", "identity":
+			case "gzip", "x-gzip", "deflate", "br", "zstd":
+				decoded, err := newBodyDecoder(info.ContentEncoding, body)
+				if err != nil {
+					writeBodyError(w, err)
+					return
+				}
+				decoded = &expansionLimiter{ReadCloser: decoded, info: info}
+				if maxSize > 0 {
+					decoded = http.MaxBytesReader(w, decoded, maxSize)
+				}
+				body = decoded
+
+				// the body is passed on decompressed
+				r.Header.Del("Content-Encoding")
+				r.Header.Del("Content-Length")
+				r.ContentLength = -1
+			default:
+				http.Error(w, fmt.Sprintf("unsupported Content-Encoding %q", info.ContentEncoding), http.StatusUnsupportedMediaType)
+				return
+			}
+
+			r.Body = body
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// newBodyDecoder returns a reader decompressing body.
+func newBodyDecoder(encoding string, body io.ReadCloser) (io.ReadCloser, error) {
+	var decoded io.Reader
+	switch encoding {
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, fmt.Errorf("decompressing gzip body: %w", err)
+		}
+		decoded = gz
+	case "deflate":
+		zr, err := zlib.NewReader(body)
+		if err != nil {
+			return nil, fmt.Errorf("decompressing deflate body: %w", err)
+		}
+		decoded = zr
+	case "br":
+		decoded = brotli.NewReader(body)
+	case "zstd":
+		zr, err := zstd.NewReader(body, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(1<<23))
+		if err != nil {
+			return nil, fmt.Errorf("decompressing zstd body: %w", err)
+		}
+		return &decodedBody{Reader: zr, close: func() error {
+			zr.Close()
+			return body.Close()
+		}}, nil
+	}
+	return &decodedBody{Reader: decoded, close: body.Close}, nil
+}
+
+type decodedBody struct {
+	io.Reader
+	close func() error
+}
+
+func (d *decodedBody) Close() error {
+	return d.close()
+}
+
+// receivedCounter counts the bytes read from the body as received.
+type receivedCounter struct {
+	io.ReadCloser
+	info *RequestBody
+}
+
+func (c *receivedCounter) Read(b []byte) (int, error) {
+	n, err := c.ReadCloser.Read(b)
+	c.info.received.Add(int64(n))
+	return n, err
+}
+
+// expansionLimiter fails reading a decompressed body once it exceeds the
+// expansion ratio to the received bytes.
+type expansionLimiter struct {
+	io.ReadCloser
+	info    *RequestBody
+	decoded int64
+}
+
+func (l *expansionLimiter) Read(b []byte) (int, error) {
+	n, err := l.ReadCloser.Read(b)
+	l.decoded += int64(n)
+	if l.decoded > l.info.Received()*maxExpansionRatio+maxExpansionSlack {
+		return 0, errBodyExpansion
+	}
+	return n, err
+}
+
+// writeBodyError responds with 413 if err is caused by a body exceeding the
+// limits of NewRequestBodyMiddleware, or 400 otherwise.
+func writeBodyError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errBodyExpansion) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		http.Error(w, fmt.Sprintf("request body is larger than %d bytes", maxBytesErr.Limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, fmt.Sprintf("error reading body: %v", err), http.StatusBadRequest)
+}
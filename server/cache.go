@@ -0,0 +1,182 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// cacheCounter counts the requests for one key that reached the origin.
+type cacheCounter struct {
+	Hits        uint64 `json:"hits"`
+	NotModified uint64 `json:"not_modified"`
+}
+
+// cacheResources serves resources with configurable caching headers and
+// counts the requests per key.
+type cacheResources struct {
+	started time.Time
+
+	mu       sync.Mutex
+	counters map[string]*cacheCounter
+}
+
+// RegisterCacheRoutes adds the /cache endpoints.
+func RegisterCacheRoutes(r *mux.Router) {
+	c := &cacheResources{started: time.Now(), counters: map[string]*cacheCounter{}}
+	r.Path("/cache/stats").HandlerFunc(c.statsHandler)
+	r.Path("/cache/{key}").HandlerFunc(c.resourceHandler)
+}
+
+type jsonCacheResource struct {
+	Key     string            `json:"key"`
+	Version int64             `json:"version"`
+	Vary    map[string]string `json:"vary,omitempty"`
+}
+
+// resourceHandler serves a resource per key, which only changes with its
+// version and the request headers listed in Vary. The query parameters are:
+//
+//   - cache-control: the Cache-Control header (default `public, max-age=60`)
+//   - etag: strong (default), weak or none
+//   - last-modified: true (default) sets Last-Modified to the start of the
+//     version
+//   - rotate: changes the version every N seconds, it is constant otherwise
+//   - vary: comma separated request headers the resource varies on
+//
+// Conditional requests are answered with 304 if the resource did not change.
+func (c *cacheResources) resourceHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	query := r.URL.Query()
+
+	modified := c.started
+	var version int64
+	if v := query.Get("rotate"); v != "" {
+		seconds, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || seconds <= 0 {
+			http.Error(w, "rotate must be a positive number of seconds", http.StatusBadRequest)
+			return
+		}
+		version = time.Now().Unix() / seconds
+		modified = time.Unix(version*seconds, 0)
+	}
+
+	resource := jsonCacheResource{Key: key, Version: version}
+	if vary := splitHeaderList(query["vary"]); len(vary) > 0 {
+		resource.Vary = map[string]string{}
+		for i, name := range vary {
+			vary[i] = http.CanonicalHeaderKey(name)
+			resource.Vary[vary[i]] = r.Header.Get(name)
+		}
+		w.Header().Set("Vary", strings.Join(vary, ", "))
+	}
+
+	var body bytes.Buffer
+	e := json.NewEncoder(&body)
+	e.SetIndent("", "  ")
+	if err := e.Encode(resource); err != nil {
+		logrus.Errorf("json marshal: %v", err)
+	}
+
+	cacheControl := "public, max-age=60"
+	if query.Has("cache-control") {
+		cacheControl = query.Get("cache-control")
+	}
+	if cacheControl != "" {
+		w.Header().Set("Cache-Control", cacheControl)
+	}
+
+	sum := sha256.Sum256(body.Bytes())
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+	switch query.Get("etag") {
+	case "", "strong":
+		w.Header().Set("ETag", etag)
+	case "weak":
+		w.Header().Set("ETag", "W/"+etag)
+	case "none":
+	default:
+		http.Error(w, "etag must be strong, weak or none", http.StatusBadRequest)
+		return
+	}
+
+	if query.Get("last-modified") == "false" {
+		modified = time.Time{}
+	}
+
+	hits := c.count(key, func(counter *cacheCounter) {
+		counter.Hits++
+	})
+	w.Header().Set("X-Origin-Hits", strconv.FormatUint(hits.Hits, 10))
+	w.Header().Set("Content-Type", "application/json")
+
+	cw := &statusRecorder{ResponseWriter: w}
+	http.ServeContent(cw, r, "", modified, bytes.NewReader(body.Bytes()))
+	if cw.status == http.StatusNotModified {
+		c.count(key, func(counter *cacheCounter) {
+			counter.NotModified++
+		})
+	}
+}
+
+// count updates the counter of key with fn and returns a copy.
+func (c *cacheResources) count(key string, fn func(*cacheCounter)) cacheCounter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	counter, ok := c.counters[key]
+	if !ok {
+		counter = &cacheCounter{}
+		c.counters[key] = counter
+	}
+	fn(counter)
+	return *counter
+}
+
+type jsonCacheStats struct {
+	Key string `json:"key"`
+	cacheCounter
+}
+
+// statsHandler responds with the counters of all keys, DELETE resets them.
+func (c *cacheResources) statsHandler(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	if r.Method == http.MethodDelete {
+		c.counters = map[string]*cacheCounter{}
+	}
+	stats := make([]jsonCacheStats, 0, len(c.counters))
+	for key, counter := range c.counters {
+		stats = append(stats, jsonCacheStats{Key: key, cacheCounter: *counter})
+	}
+	c.mu.Unlock()
+
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Key < stats[j].Key })
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	if err := e.Encode(stats); err != nil {
+		logrus.Errorf("json marshal: %v", err)
+	}
+}
+
+// statusRecorder remembers the status code written.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
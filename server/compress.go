@@ -0,0 +1,383 @@
+package server
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/sirupsen/logrus"
+)
+
+// uncompressedPaths are not compressed by the compress middleware, as
+// buffering of the compression would defeat their timing, or ranges have to
+// refer to the uncompressed payload. Forcing compression or broken responses
+// on them is rejected.
+var uncompressedPaths = map[string]bool{
+	"/respond-with/bytes": true,
+	"/respond-with/slow":  true,
+}
+
+// compressEncodings are the supported content codings, preferred first.
+var compressEncodings = []string{"br", "zstd", "gzip", "deflate"}
+
+// Ways the compress middleware can send broken responses.
+const (
+	compressErrorMislabel = "mislabel"
+	compressErrorCorrupt  = "corrupt"
+	compressErrorTruncate = "truncate"
+)
+
+// encoder is implemented by the writers of all content codings.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+var encoderPools = map[string]*sync.Pool{
+	"br": {New: func() interface{} {
+		return brotli.NewWriter(io.Discard)
+	}},
+	"zstd": {New: func() interface{} {
+		enc, err := zstd.NewWriter(io.Discard, zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(1<<23))
+		if err != nil {
+			logrus.Fatalf("creating zstd encoder: %v", err)
+		}
+		return enc
+	}},
+	"gzip": {New: func() interface{} {
+		return gzip.NewWriter(io.Discard)
+	}},
+	"deflate": {New: func() interface{} {
+		return zlib.NewWriter(io.Discard)
+	}},
+}
+
+// NewCompressMiddleware compresses responses of at least minSize bytes with
+// the content coding preferred by the client. Brotli, zstd, gzip and deflate
+// are supported. The `compress` query parameter forces one of them regardless
+// of size and Accept-Encoding, or disables compression with `none`.
+//
+// For testing clients, `compress-error` sends broken responses: `mislabel`
+// sends the Content-Encoding header with an uncompressed body, `corrupt`
+// damages the compressed stream and `truncate` omits its end. It requires a
+// content coding, forced or negotiated, and applies regardless of size.
+//
+// HEAD requests and 204, 206 and 304 responses are never compressed, as
+// ranges refer to the uncompressed representation.
+//
+// Compressed responses get their own strong ETag, the one of the handler with
+// the content coding appended, e.g. `"abc-br"`. In If-None-Match and If-Match
+// the suffix is removed again before the handler compares them.
+func NewCompressMiddleware(minSize int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			query := r.URL.Query()
+			cw := &compressWriter{ResponseWriter: w, r: r, minSize: minSize, status: http.StatusOK}
+
+			switch forced := query.Get("compress"); forced {
+			case "", "auto":
+				cw.encoding = negotiateEncoding(r.Header.Values("Accept-Encoding"))
+				cw.negotiated = true
+			case "none", "identity":
+			case "br", "zstd", "gzip", "deflate":
+				cw.encoding = forced
+				cw.minSize = 0
+			default:
+				http.Error(w, fmt.Sprintf("compress must be auto, none, %s, got %q", strings.Join(compressEncodings, ", "), forced), http.StatusBadRequest)
+				return
+			}
+
+			switch cw.errorMode = query.Get("compress-error"); cw.errorMode {
+			case "", compressErrorMislabel, compressErrorCorrupt, compressErrorTruncate:
+			default:
+				http.Error(w, fmt.Sprintf("compress-error must be mislabel, corrupt or truncate, got %q", cw.errorMode), http.StatusBadRequest)
+				return
+			}
+
+			if uncompressedPaths[r.URL.Path] {
+				if (cw.encoding != "" && !cw.negotiated) || cw.errorMode != "" {
+					http.Error(w, fmt.Sprintf("%s does not support compress and compress-error", r.URL.Path), http.StatusBadRequest)
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if cw.errorMode != "" {
+				if cw.encoding == "" {
+					http.Error(w, "compress-error requires a content coding, via compress or Accept-Encoding", http.StatusBadRequest)
+					return
+				}
+				// the broken response is sent regardless of size
+				cw.minSize = 0
+			}
+			if cw.encoding != "" {
+				for _, name := range []string{"If-None-Match", "If-Match"} {
+					if v := r.Header.Get(name); v != "" {
+						if stripped, ok := stripETagCoding(v, cw.encoding); ok {
+							r.Header.Set(name, stripped)
+							cw.codedETag = true
+						}
+					}
+				}
+			}
+
+			defer cw.finish()
+			next.ServeHTTP(cw, r)
+		})
+	}
+}
+
+// negotiateEncoding returns the supported content coding with the highest
+// quality in the Accept-Encoding headers, or "" for none.
+func negotiateEncoding(acceptEncoding []string) string {
+	qualities := map[string]float64{}
+	for _, element := range splitHeaderList(acceptEncoding) {
+		coding, params, _ := strings.Cut(element, ";")
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(name, "q") {
+				if v, err := strconv.ParseFloat(value, 64); err == nil {
+					q = v
+				}
+			}
+		}
+		qualities[strings.ToLower(strings.TrimSpace(coding))] = q
+	}
+
+	best, bestQuality := "", 0.0
+	for _, coding := range compressEncodings {
+		q, ok := qualities[coding]
+		if !ok {
+			q, ok = qualities["*"]
+		}
+		if ok && q > bestQuality {
+			best, bestQuality = coding, q
+		}
+	}
+	return best
+}
+
+// compressWriter buffers the response until minSize bytes were written,
+// before deciding whether to compress it.
+type compressWriter struct {
+	http.ResponseWriter
+	r          *http.Request
+	encoding   string
+	negotiated bool
+	errorMode  string
+	minSize    int
+	// codedETag is set if the conditional request carried the ETag of a
+	// compressed response
+	codedETag bool
+
+	status      int
+	wroteHeader bool
+	buf         []byte
+	decided     bool
+	hijacked    bool
+	enc         encoder
+}
+
+func (c *compressWriter) WriteHeader(status int) {
+	if c.wroteHeader || c.decided {
+		return
+	}
+	// informational responses are sent as they are
+	if status >= 100 && status < 200 {
+		c.ResponseWriter.WriteHeader(status)
+		return
+	}
+	c.status = status
+	c.wroteHeader = true
+}
+
+func (c *compressWriter) Write(b []byte) (int, error) {
+	c.wroteHeader = true
+	if !c.decided {
+		c.buf = append(c.buf, b...)
+		if len(c.buf) >= c.minSize {
+			if err := c.decide(true); err != nil {
+				return 0, err
+			}
+		}
+		return len(b), nil
+	}
+
+	if c.enc != nil {
+		return c.enc.Write(b)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+func (c *compressWriter) Flush() {
+	if !c.decided {
+		// streamed responses are compressed, as their size is unknown
+		if err := c.decide(true); err != nil {
+			return
+		}
+	}
+	if c.enc != nil {
+		c.enc.Flush()
+	}
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (c *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := c.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T does not support hijacking", c.ResponseWriter)
+	}
+	conn, bufrw, err := hj.Hijack()
+	if err == nil {
+		c.hijacked = true
+	}
+	return conn, bufrw, err
+}
+
+// decide sends the header and the buffered body, compressed if compress is
+// set and the response allows it.
+func (c *compressWriter) decide(compress bool) error {
+	c.decided = true
+	h := c.Header()
+
+	if len(c.buf) > 0 && h.Get("Content-Type") == "" {
+		h.Set("Content-Type", http.DetectContentType(c.buf))
+	}
+
+	if c.negotiated && !headerContains(h.Values("Vary"), "Accept-Encoding") {
+		h.Add("Vary", "Accept-Encoding")
+	}
+
+	// a 304 refers to the representation the client has
+	if c.status == http.StatusNotModified && c.codedETag {
+		c.codeETag()
+	}
+
+	if c.encoding == "" || !compress || c.r.Method == http.MethodHead ||
+		c.status == http.StatusNoContent || c.status == http.StatusNotModified ||
+		c.status == http.StatusPartialContent || h.Get("Content-Encoding") != "" {
+		c.ResponseWriter.WriteHeader(c.status)
+		_, err := c.ResponseWriter.Write(c.buf)
+		return err
+	}
+
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", c.encoding)
+	c.codeETag()
+	c.ResponseWriter.WriteHeader(c.status)
+
+	if c.errorMode == compressErrorMislabel {
+		_, err := c.ResponseWriter.Write(c.buf)
+		return err
+	}
+
+	var out io.Writer = c.ResponseWriter
+	if c.errorMode == compressErrorCorrupt {
+		out = &corruptingWriter{w: out}
+	}
+	c.enc = encoderPools[c.encoding].Get().(encoder)
+	c.enc.Reset(out)
+	_, err := c.enc.Write(c.buf)
+	return err
+}
+
+// codeETag appends the content coding to a strong ETag, as the compressed
+// representation is not byte-identical. Weak ETags are kept.
+func (c *compressWriter) codeETag() {
+	h := c.Header()
+	if etag := h.Get("ETag"); strings.HasPrefix(etag, `"`) && strings.HasSuffix(etag, `"`) && len(etag) > 1 {
+		h.Set("ETag", etag[:len(etag)-1]+"-"+c.encoding+`"`)
+	}
+}
+
+// stripETagCoding removes the suffix of coding from the entity tags in the
+// header value and reports whether any tag had it.
+func stripETagCoding(value, coding string) (string, bool) {
+	suffix := "-" + coding + `"`
+	tags := splitHeaderList([]string{value})
+	stripped := false
+	for i, tag := range tags {
+		if strings.HasSuffix(tag, suffix) {
+			tags[i] = strings.TrimSuffix(tag, suffix) + `"`
+			stripped = true
+		}
+	}
+	return strings.Join(tags, ", "), stripped
+}
+
+// finish completes the response after the handler returned.
+func (c *compressWriter) finish() {
+	if c.hijacked {
+		return
+	}
+	if !c.decided {
+		if !c.wroteHeader {
+			// let net/http send its default response
+			return
+		}
+		if err := c.decide(len(c.buf) > 0 && len(c.buf) >= c.minSize); err != nil {
+			logrus.Debugf("compress: %v", err)
+		}
+	}
+	if c.enc == nil {
+		return
+	}
+
+	var err error
+	if c.errorMode == compressErrorTruncate {
+		// the end of the stream is never written
+		err = c.enc.Flush()
+	} else {
+		err = c.enc.Close()
+	}
+	if err != nil {
+		logrus.Debugf("compress: %v", err)
+	}
+
+	c.enc.Reset(io.Discard)
+	encoderPools[c.encoding].Put(c.enc)
+	c.enc = nil
+}
+
+// corruptingWriter inverts every 16th byte, starting with the fifth.
+type corruptingWriter struct {
+	w      io.Writer
+	offset int
+}
+
+func (c *corruptingWriter) Write(b []byte) (int, error) {
+	corrupted := make([]byte, len(b))
+	for i, v := range b {
+		if (c.offset+i)%16 == 4 {
+			v ^= 0xff
+		}
+		corrupted[i] = v
+	}
+	c.offset += len(b)
+	return c.w.Write(corrupted)
+}
+
+// headerContains reports whether the comma separated header values contain
+// token, ignoring case.
+func headerContains(values []string, token string) bool {
+	for _, v := range splitHeaderList(values) {
+		if strings.EqualFold(v, token) {
+			return true
+		}
+	}
+	return false
+}
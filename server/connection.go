@@ -0,0 +1,202 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stormforger/testapp/internal/conninfo"
+)
+
+// Connection identifies the connection of a request and the position of the
+// request on it.
+type Connection struct {
+	ID      uint64 `json:"id"`
+	Request uint64 `json:"request"`
+}
+
+type connectionContextKey struct{}
+
+// ConnectionFromRequest returns the connection ID and request sequence number
+// counted by the middleware of NewConnectionMiddleware.
+func ConnectionFromRequest(r *http.Request) Connection {
+	if c, ok := r.Context().Value(connectionContextKey{}).(Connection); ok {
+		return c
+	}
+	return Connection{ID: conninfo.ID(r.Context())}
+}
+
+// NewConnectionMiddleware counts the requests per connection and reports them
+// via the X-Connection-Id and X-Connection-Request response headers.
+//
+// The connection is closed after the response if maxRequests (0 meaning
+// unlimited) is reached or the `connection` query parameter is `close`, by
+// sending `Connection: close`. With `connection=drop` the connection is closed
+// after the response without announcing it, which requires HTTP/1.x.
+func NewConnectionMiddleware(maxRequests uint64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c := Connection{ID: conninfo.ID(r.Context()), Request: conninfo.NextRequest(r.Context())}
+			r = r.WithContext(context.WithValue(r.Context(), connectionContextKey{}, c))
+
+			if c.ID != 0 {
+				w.Header().Set("X-Connection-Id", strconv.FormatUint(c.ID, 10))
+				w.Header().Set("X-Connection-Request", strconv.FormatUint(c.Request, 10))
+			}
+
+			switch r.URL.Query().Get("connection") {
+			case "close":
+				w.Header().Set("Connection", "close")
+			case "drop":
+				if _, ok := w.(http.Hijacker); ok && r.ProtoMajor == 1 {
+					dropAfterResponse(w, r, next)
+					return
+				}
+				logrus.Debugf("connection=drop requires HTTP/1.x, got %s", r.Proto)
+			}
+			if maxRequests > 0 && c.Request >= maxRequests {
+				w.Header().Set("Connection", "close")
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// dropAfterResponse takes over the connection once next starts responding,
+// writes the response straight to it and closes it afterwards.
+func dropAfterResponse(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	d := &dropWriter{hj: w.(http.Hijacker), r: r, header: w.Header()}
+	defer d.finish()
+	next.ServeHTTP(d, r)
+}
+
+// dropWriter is an http.ResponseWriter writing HTTP/1.1 to a hijacked
+// connection. Responses without Content-Length are sent chunked.
+type dropWriter struct {
+	hj     http.Hijacker
+	r      *http.Request
+	header http.Header
+
+	conn        net.Conn
+	bufrw       *bufio.ReadWriter
+	err         error
+	wroteHeader bool
+	// handlerHijacked is set if the handler took over the connection
+	handlerHijacked bool
+	body            io.Writer
+	chunked         io.WriteCloser
+}
+
+func (d *dropWriter) Header() http.Header {
+	return d.header
+}
+
+// hijack takes over the connection on first use, as the request body must
+// not be read afterwards.
+func (d *dropWriter) hijack() error {
+	if d.conn == nil && d.err == nil {
+		d.conn, d.bufrw, d.err = d.hj.Hijack()
+		if d.err != nil {
+			logrus.Errorf("hijacking connection: %v", d.err)
+		}
+	}
+	return d.err
+}
+
+func (d *dropWriter) WriteHeader(status int) {
+	if d.wroteHeader || d.handlerHijacked || d.hijack() != nil {
+		return
+	}
+	fmt.Fprintf(d.bufrw, "HTTP/1.1 %03d %s\r\n", status, http.StatusText(status))
+	// informational responses are followed by the final one
+	if status >= 100 && status < 200 {
+		d.header.Write(d.bufrw)
+		d.bufrw.WriteString("\r\n")
+		d.bufrw.Flush()
+		return
+	}
+	d.wroteHeader = true
+
+	if d.header.Get("Date") == "" {
+		d.header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+	d.body = io.Discard
+	if d.r.Method != http.MethodHead && status != http.StatusNoContent && status != http.StatusNotModified {
+		d.body = d.bufrw
+		if d.header.Get("Content-Length") == "" {
+			d.header.Set("Transfer-Encoding", "chunked")
+			d.chunked = httputil.NewChunkedWriter(d.bufrw)
+			d.body = d.chunked
+		}
+	}
+	d.header.Write(d.bufrw)
+	d.bufrw.WriteString("\r\n")
+}
+
+func (d *dropWriter) Write(b []byte) (int, error) {
+	if !d.wroteHeader {
+		if d.header.Get("Content-Type") == "" {
+			d.header.Set("Content-Type", http.DetectContentType(b))
+		}
+		d.WriteHeader(http.StatusOK)
+	}
+	if d.body == nil {
+		return 0, http.ErrHijacked
+	}
+	return d.body.Write(b)
+}
+
+func (d *dropWriter) Flush() {
+	if !d.wroteHeader {
+		d.WriteHeader(http.StatusOK)
+	}
+	if d.bufrw != nil && !d.handlerHijacked {
+		d.bufrw.Flush()
+	}
+}
+
+func (d *dropWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if d.handlerHijacked {
+		return nil, nil, http.ErrHijacked
+	}
+	if err := d.hijack(); err != nil {
+		return nil, nil, err
+	}
+	if err := d.bufrw.Flush(); err != nil {
+		return nil, nil, err
+	}
+	d.handlerHijacked = true
+	return d.conn, d.bufrw, nil
+}
+
+// finish completes the response and closes the connection, unless the
+// handler took it over.
+func (d *dropWriter) finish() {
+	if d.handlerHijacked {
+		return
+	}
+	if !d.wroteHeader {
+		d.WriteHeader(http.StatusOK)
+	}
+	if d.conn == nil {
+		return
+	}
+	defer d.conn.Close()
+
+	if d.chunked != nil {
+		d.chunked.Close()
+		// no trailers
+		d.bufrw.WriteString("\r\n")
+	}
+	if err := d.bufrw.Flush(); err != nil {
+		logrus.Debugf("writing response before dropping connection: %v", err)
+	}
+}
@@ -0,0 +1,268 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// CookieSigner signs the values generated by SetCookieHandler, so
+// RequiresCookieHandler can verify them without keeping state.
+type CookieSigner struct {
+	key []byte
+}
+
+// NewCookieSigner returns a signer with a key derived from secret, so values
+// can be verified by every instance sharing the secret, or a random key if
+// it is empty.
+func NewCookieSigner(secret []byte) *CookieSigner {
+	if len(secret) == 0 {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			logrus.Fatalf("generating cookie signing key: %v", err)
+		}
+		return &CookieSigner{key: key}
+	}
+
+	// derived, so the key differs from the one signing sessions
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("testapp cookie values"))
+	return &CookieSigner{key: mac.Sum(nil)}
+}
+
+// sign returns the signature of a generated value of the cookie name.
+func (s *CookieSigner) sign(name, value string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(name + "=" + value))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// verify reports whether value was generated by SetCookieHandler for the
+// cookie name.
+func (s *CookieSigner) verify(name, value string) bool {
+	random, signature, found := strings.Cut(value, ".")
+	if !found {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(s.sign(name, random)))
+}
+
+// SetCookieHandler serves a response with one cookie per `cookie` query
+// parameter, given as `name` or `name=value`. Without value, a signed random
+// value is generated. The attributes are set by the `domain`, `path`,
+// `expires` (HTTP date or duration from now), `max-age` (seconds), `secure`,
+// `httponly`, `samesite` (lax, strict or none) and `partitioned` parameters.
+// Secure defaults to whether the request was made via HTTPS.
+func (s *CookieSigner) SetCookieHandler(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+
+	names := query["cookie"]
+	if len(names) == 0 {
+		names = []string{"sessionid"}
+	}
+
+	template, partitioned, err := cookieAttributes(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var headers []string
+	for _, name := range names {
+		c := template
+		var found bool
+		c.Name, c.Value, found = strings.Cut(name, "=")
+		if !found {
+			c.Value = fmt.Sprintf("%d", randMinMax(1_000_000, 9_000_000))
+			c.Value += "." + s.sign(c.Name, c.Value)
+		}
+
+		header := c.String()
+		if header == "" {
+			http.Error(w, fmt.Sprintf("invalid cookie name %q", c.Name), http.StatusBadRequest)
+			return
+		}
+		// http.Cookie does not support the Partitioned attribute
+		if partitioned {
+			header += "; Partitioned"
+		}
+		headers = append(headers, header)
+	}
+	for _, header := range headers {
+		w.Header().Add("Set-Cookie", header)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "Cookie served.")
+}
+
+// DeleteCookieHandler expires the cookies named by the `cookie` query
+// parameters. `domain` and `path` have to match the ones the cookies were set
+// with.
+func DeleteCookieHandler(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+
+	names := query["cookie"]
+	if len(names) == 0 {
+		names = []string{"sessionid"}
+	}
+
+	for _, name := range names {
+		http.SetCookie(w, &http.Cookie{
+			Name:    name,
+			Domain:  query.Get("domain"),
+			Path:    query.Get("path"),
+			Expires: time.Unix(0, 0),
+			MaxAge:  -1,
+		})
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "Cookie deleted.")
+}
+
+// RequiresCookieHandler serves a forbidden response if no cookie is found.
+// Every cookie is accepted, unless the `value` query parameter requires a
+// specific value or `verify=true` requires a value generated by
+// SetCookieHandler.
+func (s *CookieSigner) RequiresCookieHandler(w http.ResponseWriter, req *http.Request) {
+	cookieName := req.FormValue("cookie")
+	if cookieName == "" {
+		cookieName = "sessionid"
+	}
+
+	c, err := req.Cookie(cookieName)
+	if err == http.ErrNoCookie {
+		http.Error(w, "cookie required", http.StatusForbidden)
+		return
+	}
+
+	if expected := req.URL.Query().Get("value"); expected != "" && c.Value != expected {
+		http.Error(w, fmt.Sprintf("cookie %s has value %q, expected %q", c.Name, c.Value, expected), http.StatusForbidden)
+		return
+	}
+	if req.URL.Query().Get("verify") == "true" && !s.verify(c.Name, c.Value) {
+		http.Error(w, fmt.Sprintf("cookie %s has value %q, which was not issued by this server", c.Name, c.Value), http.StatusForbidden)
+		return
+	}
+
+	fmt.Fprintf(w, "Hello. Your cookie is %s=%s", c.Name, c.Value)
+}
+
+type jsonCookieJar struct {
+	Headers []string     `json:"headers"`
+	Cookies []jsonCookie `json:"cookies"`
+}
+
+type jsonCookie struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Verified bool   `json:"verified"`
+}
+
+// CookieJarHandler returns the Cookie headers of the request and the cookies
+// parsed from them as JSON, including duplicate names in the order sent.
+func (s *CookieSigner) CookieJarHandler(w http.ResponseWriter, req *http.Request) {
+	jar := jsonCookieJar{
+		Headers: req.Header.Values("Cookie"),
+		Cookies: []jsonCookie{},
+	}
+	if jar.Headers == nil {
+		jar.Headers = []string{}
+	}
+	for _, c := range req.Cookies() {
+		jar.Cookies = append(jar.Cookies, jsonCookie{
+			Name:     c.Name,
+			Value:    c.Value,
+			Verified: s.verify(c.Name, c.Value),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	if err := e.Encode(jar); err != nil {
+		logrus.Errorf("json marshal: %v", err)
+	}
+}
+
+// cookieAttributes returns a cookie with the attributes requested by the
+// query parameters of req, and whether it is partitioned.
+func cookieAttributes(req *http.Request) (http.Cookie, bool, error) {
+	query := req.URL.Query()
+	c := http.Cookie{
+		Domain: query.Get("domain"),
+		Path:   query.Get("path"),
+		Secure: ForwardedFromRequest(req).Scheme == "https",
+	}
+
+	if v := query.Get("expires"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			c.Expires = time.Now().Add(d)
+		} else if t, err := http.ParseTime(v); err == nil {
+			c.Expires = t
+		} else {
+			return c, false, fmt.Errorf("expires must be a duration or HTTP date, got %q", v)
+		}
+	}
+
+	if v := query.Get("max-age"); v != "" {
+		maxAge, err := strconv.Atoi(v)
+		if err != nil {
+			return c, false, fmt.Errorf("max-age must be a number, got %q", v)
+		}
+		// http.Cookie uses negative values for `Max-Age=0`
+		if maxAge <= 0 {
+			maxAge = -1
+		}
+		c.MaxAge = maxAge
+	}
+
+	flags := []struct {
+		name  string
+		value *bool
+	}{
+		{"secure", &c.Secure},
+		{"httponly", &c.HttpOnly},
+	}
+	for _, f := range flags {
+		if v := query.Get(f.name); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return c, false, fmt.Errorf("%s must be true or false, got %q", f.name, v)
+			}
+			*f.value = b
+		}
+	}
+
+	switch v := strings.ToLower(query.Get("samesite")); v {
+	case "":
+	case "lax":
+		c.SameSite = http.SameSiteLaxMode
+	case "strict":
+		c.SameSite = http.SameSiteStrictMode
+	case "none":
+		c.SameSite = http.SameSiteNoneMode
+	default:
+		return c, false, fmt.Errorf("samesite must be lax, strict or none, got %q", v)
+	}
+
+	var partitioned bool
+	if v := query.Get("partitioned"); v != "" {
+		var err error
+		if partitioned, err = strconv.ParseBool(v); err != nil {
+			return c, false, fmt.Errorf("partitioned must be true or false, got %q", v)
+		}
+	}
+
+	return c, partitioned, nil
+}
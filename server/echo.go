@@ -1,24 +1,73 @@
 package server
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httputil"
+	"os"
 	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stormforger/testapp/internal/proxyproto"
+	"github.com/stormforger/testapp/internal/tlsutil"
 )
 
+// DefaultEchoMaxBodySize is the default size up to which request bodies are
+// included in the echo.
+const DefaultEchoMaxBodySize = 10_000
+
+// EchoConfig configures the echo handler.
+type EchoConfig struct {
+	// MaxBodySize is the size up to which request bodies are included in the
+	// echo, larger ones are truncated. 0 means unlimited.
+	MaxBodySize int64
+}
+
 // EchoHandler is a simple http.Handler for debugging webrequest.
 // Each request is sent back to the client as the payload.
 func EchoHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/plain")
+	EchoConfig{MaxBodySize: DefaultEchoMaxBodySize}.ServeHTTP(w, r)
+}
+
+// ServeHTTP sends the request back to the client as the payload, including
+// the body up to MaxBodySize. The size and SHA-256 checksum of the whole body
+// are sent in the X-Echo-Body-Size and X-Echo-Body-SHA256 headers.
+func (c EchoConfig) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Feature: respond with JSON instead of the raw request
+	jsonFormat := r.URL.Query().Get("format") == "json"
+	if jsonFormat {
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		w.Header().Set("Content-Type", "text/plain")
+	}
 
 	// Feature: inject redirect location header
 	location := r.URL.Query().Get("location")
+	if strings.HasPrefix(location, "/") && !strings.HasPrefix(location, "//") {
+		location = AbsoluteURL(r, location)
+	}
 	if location != "" {
 		w.Header().Add("location", location)
 	}
 
+	// Feature: report the TLS fingerprint of the client
+	if hello := tlsutil.ClientHelloFromContext(r.Context()); hello != nil {
+		_, ja3 := hello.JA3()
+		ja4, _ := hello.JA4()
+		w.Header().Set("X-TLS-JA3", ja3)
+		w.Header().Set("X-TLS-JA4", ja4)
+	}
+
 	// Feature: Change the response status
+	status := http.StatusOK
 	answerStatus := r.URL.Query().Get("status")
 	if answerStatus != "" {
 		code, err := strconv.Atoi(answerStatus)
@@ -27,27 +76,286 @@ func EchoHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if code >= 100 && code <= 999 {
-			w.WriteHeader(code)
+			status = code
 		}
 	}
 
-	// Exclude request body if too large
-	if r.ContentLength > 10_000 {
+	// Feature: send back only the body, without keeping it in memory
+	if r.URL.Query().Get("stream") == "true" {
+		streamEcho(w, r, status)
+		return
+	}
+
+	body, err := readEchoBody(r, c.MaxBodySize)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	w.Header().Set("X-Echo-Body-Size", strconv.FormatInt(body.size, 10))
+	w.Header().Set("X-Echo-Body-SHA256", body.sha256)
+
+	if jsonFormat {
+		w.WriteHeader(status)
+		writeJSONEcho(w, r, body)
+		return
+	}
+
+	if body.truncated {
 		reqDump, err := httputil.DumpRequest(r, false)
 		if err != nil {
-			fmt.Fprintf(w, "Could not dump request")
+			http.Error(w, "Could not dump request", http.StatusInternalServerError)
 			return
 		}
 
+		w.WriteHeader(status)
 		w.Write(reqDump)
+		w.Write(body.data)
+		fmt.Fprintf(w, "\n[truncated: %d of %d bytes shown]\n", len(body.data), body.size)
 		return
 	}
 
+	r.Body = io.NopCloser(bytes.NewReader(body.data))
 	reqDump, err := httputil.DumpRequest(r, true)
 	if err != nil {
-		fmt.Fprintf(w, "Could not dump request")
+		http.Error(w, "Could not dump request", http.StatusInternalServerError)
 		return
 	}
 
+	w.WriteHeader(status)
 	w.Write(reqDump)
 }
+
+// echoBody is a request body, read up to a maximum size.
+type echoBody struct {
+	data      []byte
+	size      int64
+	sha256    string
+	truncated bool
+}
+
+// readEchoBody reads the whole body of r, keeping the first maxSize bytes,
+// all of them if maxSize is 0.
+func readEchoBody(r *http.Request, maxSize int64) (echoBody, error) {
+	var data bytes.Buffer
+	var keep io.Writer = &data
+	if maxSize > 0 {
+		keep = &limitedWriter{w: &data, n: maxSize}
+	}
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(keep, hash), r.Body)
+	if err != nil {
+		return echoBody{}, err
+	}
+
+	return echoBody{
+		data:      data.Bytes(),
+		size:      size,
+		sha256:    hex.EncodeToString(hash.Sum(nil)),
+		truncated: int64(data.Len()) < size,
+	}, nil
+}
+
+// limitedWriter writes the first n bytes to w and drops the rest.
+type limitedWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (l *limitedWriter) Write(b []byte) (int, error) {
+	if l.n > 0 {
+		keep := b
+		if int64(len(keep)) > l.n {
+			keep = keep[:l.n]
+		}
+		n, err := l.w.Write(keep)
+		l.n -= int64(n)
+		if err != nil {
+			return n, err
+		}
+	}
+	return len(b), nil
+}
+
+// maxSpooledEchoSize limits the request bodies spooled by streamEcho.
+const maxSpooledEchoSize = 100 << 20
+
+// streamEcho sends the request body back with the Content-Type of the
+// request. Via HTTP/2, the body is sent back while it is received, with its
+// size and checksum as trailers. The HTTP/1.x server stops reading the
+// request once the response is sent, so the body is spooled to a temporary
+// file first, limited to maxSpooledEchoSize bytes.
+func streamEcho(w http.ResponseWriter, r *http.Request, status int) {
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+
+	if r.ProtoMajor >= 2 {
+		pipeEcho(w, r, status)
+		return
+	}
+
+	if r.ContentLength > maxSpooledEchoSize {
+		http.Error(w, fmt.Sprintf("request body is larger than %d bytes", maxSpooledEchoSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	f, err := os.CreateTemp("", "testapp-echo-")
+	if err != nil {
+		http.Error(w, "Could not buffer request body", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, hash), http.MaxBytesReader(w, r.Body, maxSpooledEchoSize))
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		http.Error(w, "Could not read buffered request body", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.Header().Set("X-Echo-Body-Size", strconv.FormatInt(size, 10))
+	w.Header().Set("X-Echo-Body-SHA256", hex.EncodeToString(hash.Sum(nil)))
+	w.WriteHeader(status)
+
+	if _, err := io.Copy(w, f); err != nil {
+		logrus.Debugf("stream echo: %v", err)
+	}
+}
+
+// pipeEcho sends the request body back while reading it, flushing each
+// chunk.
+func pipeEcho(w http.ResponseWriter, r *http.Request, status int) {
+	w.Header().Set("Trailer", "X-Echo-Body-Size, X-Echo-Body-SHA256")
+	w.WriteHeader(status)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	hash := sha256.New()
+	var size int64
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Body.Read(buf)
+		if n > 0 {
+			hash.Write(buf[:n])
+			size += int64(n)
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				logrus.Debugf("stream echo: %v", werr)
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// the status was already sent, the response is aborted
+			logrus.Debugf("stream echo: %v", err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+
+	w.Header().Set("X-Echo-Body-Size", strconv.FormatInt(size, 10))
+	w.Header().Set("X-Echo-Body-SHA256", hex.EncodeToString(hash.Sum(nil)))
+}
+
+type jsonEcho struct {
+	Method        string             `json:"method"`
+	URL           string             `json:"url"`
+	Proto         string             `json:"proto"`
+	Host          string             `json:"host"`
+	RemoteAddr    string             `json:"remote_addr"`
+	Header        http.Header        `json:"headers"`
+	Body          string             `json:"body,omitempty"`
+	BodySize      int64              `json:"body_size"`
+	BodySHA256    string             `json:"body_sha256"`
+	BodyTruncated bool               `json:"body_truncated,omitempty"`
+	Resolved      Forwarded          `json:"resolved"`
+	Connection    Connection         `json:"connection"`
+	ProxyProtocol *jsonProxyProtocol `json:"proxy_protocol,omitempty"`
+}
+
+type jsonProxyProtocol struct {
+	Version     int       `json:"version"`
+	Local       bool      `json:"local,omitempty"`
+	Source      string    `json:"source,omitempty"`
+	Destination string    `json:"destination,omitempty"`
+	TLVs        []jsonTLV `json:"tlvs,omitempty"`
+}
+
+// jsonTLV contains the value of a TLV as text if it is printable, otherwise
+// hex encoded.
+type jsonTLV struct {
+	Type     uint8  `json:"type"`
+	Name     string `json:"name"`
+	Value    string `json:"value,omitempty"`
+	ValueHex string `json:"value_hex,omitempty"`
+}
+
+func writeJSONEcho(w http.ResponseWriter, r *http.Request, body echoBody) {
+	echo := jsonEcho{
+		Method:     r.Method,
+		URL:        r.URL.RequestURI(),
+		Proto:      r.Proto,
+		Host:       r.Host,
+		RemoteAddr: r.RemoteAddr,
+		Header:     r.Header,
+		Resolved:   ForwardedFromRequest(r),
+		Connection: ConnectionFromRequest(r),
+
+		Body:          string(body.data),
+		BodySize:      body.size,
+		BodySHA256:    body.sha256,
+		BodyTruncated: body.truncated,
+	}
+
+	if h := proxyproto.HeaderFromContext(r.Context()); h != nil {
+		p := &jsonProxyProtocol{Version: h.Version, Local: h.Local}
+		if h.Source != nil {
+			p.Source = h.Source.String()
+		}
+		if h.Destination != nil {
+			p.Destination = h.Destination.String()
+		}
+		for _, tlv := range h.TLVs {
+			t := jsonTLV{Type: tlv.Type, Name: tlv.Name()}
+			if isPrintable(tlv.Value) {
+				t.Value = string(tlv.Value)
+			} else {
+				t.ValueHex = hex.EncodeToString(tlv.Value)
+			}
+			p.TLVs = append(p.TLVs, t)
+		}
+		echo.ProxyProtocol = p
+	}
+
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	e.SetEscapeHTML(false)
+	if err := e.Encode(echo); err != nil {
+		logrus.Errorf("json marshal: %v", err)
+	}
+}
+
+func isPrintable(b []byte) bool {
+	if !utf8.Valid(b) {
+		return false
+	}
+	for _, r := range string(b) {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stormforger/testapp/internal/tlsutil"
+)
+
+type tlsFingerprint struct {
+	JA3       string `json:"ja3"`
+	JA3Hash   string `json:"ja3_hash"`
+	JA4       string `json:"ja4"`
+	JA4Raw    string `json:"ja4_r"`
+	UserAgent string `json:"user_agent,omitempty"`
+}
+
+// TLSFingerprintHandler responds with the JA3 and JA4 fingerprints of the
+// ClientHello the caller sent on the current connection.
+func TLSFingerprintHandler(w http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil {
+		http.Error(w, "No TLS connection", http.StatusBadRequest)
+		return
+	}
+
+	hello := tlsutil.ClientHelloFromContext(r.Context())
+	if hello == nil {
+		http.Error(w, "ClientHello not captured", http.StatusInternalServerError)
+		return
+	}
+
+	fingerprint := tlsFingerprint{UserAgent: r.UserAgent()}
+	fingerprint.JA3, fingerprint.JA3Hash = hello.JA3()
+	fingerprint.JA4, fingerprint.JA4Raw = hello.JA4()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	err := e.Encode(fingerprint)
+	if err != nil {
+		http.Error(w, "Cannot marshal TLS fingerprint.", http.StatusInternalServerError)
+		logrus.Errorf("json marshal: %v", err)
+	}
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// FormsConfig limits the forms parsed by /forms/inspect.
+type FormsConfig struct {
+	// MaxParts is the maximum number of fields and files, 0 meaning
+	// unlimited.
+	MaxParts int
+	// MaxFileSize is the maximum size of a file in bytes, 0 meaning
+	// unlimited.
+	MaxFileSize int64
+}
+
+// maxFormFieldSize limits the size of a multipart field and
+// maxURLEncodedFormSize the size of an urlencoded form, as they are kept in
+// memory.
+const (
+	maxFormFieldSize      = 1 << 20
+	maxURLEncodedFormSize = 10 << 20
+)
+
+// errFormTooLarge is returned if a form exceeds the FormsConfig limits.
+var errFormTooLarge = errors.New("form too large")
+
+// RegisterFormRoutes adds the /forms endpoints.
+func RegisterFormRoutes(r *mux.Router, config FormsConfig) {
+	r.Path("/forms/inspect").HandlerFunc(config.inspectHandler)
+}
+
+type jsonForm struct {
+	ContentType string          `json:"content_type"`
+	Fields      []jsonFormField `json:"fields"`
+	Files       []jsonFormFile  `json:"files"`
+}
+
+type jsonFormField struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type jsonFormFile struct {
+	Name        string `json:"name"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type,omitempty"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+}
+
+// inspectHandler parses a multipart/form-data or
+// application/x-www-form-urlencoded body and responds with its fields and
+// files as JSON. Files are only hashed, not kept in memory.
+func (c FormsConfig) inspectHandler(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		http.Error(w, "Content-Type must be multipart/form-data or application/x-www-form-urlencoded", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	form := jsonForm{ContentType: mediaType, Fields: []jsonFormField{}, Files: []jsonFormFile{}}
+	switch mediaType {
+	case "multipart/form-data":
+		err = c.parseMultipart(r, &form)
+	case "application/x-www-form-urlencoded":
+		err = c.parseURLEncoded(r, &form)
+	default:
+		http.Error(w, "Content-Type must be multipart/form-data or application/x-www-form-urlencoded", http.StatusUnsupportedMediaType)
+		return
+	}
+	if errors.Is(err, errFormTooLarge) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	if err := e.Encode(form); err != nil {
+		logrus.Errorf("json marshal: %v", err)
+	}
+}
+
+func (c FormsConfig) parseMultipart(r *http.Request, form *jsonForm) error {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return err
+	}
+
+	for parts := 1; ; parts++ {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if c.MaxParts > 0 && parts > c.MaxParts {
+			return fmt.Errorf("%w: more than %d parts", errFormTooLarge, c.MaxParts)
+		}
+
+		if part.FileName() == "" {
+			value, err := io.ReadAll(io.LimitReader(part, maxFormFieldSize+1))
+			if err != nil {
+				return err
+			}
+			if len(value) > maxFormFieldSize {
+				return fmt.Errorf("%w: field %q is larger than %d bytes", errFormTooLarge, part.FormName(), maxFormFieldSize)
+			}
+			form.Fields = append(form.Fields, jsonFormField{Name: part.FormName(), Value: string(value)})
+			continue
+		}
+
+		var file io.Reader = part
+		if c.MaxFileSize > 0 {
+			file = io.LimitReader(part, c.MaxFileSize+1)
+		}
+		hash := sha256.New()
+		size, err := io.Copy(hash, file)
+		if err != nil {
+			return err
+		}
+		if c.MaxFileSize > 0 && size > c.MaxFileSize {
+			return fmt.Errorf("%w: file %q is larger than %d bytes", errFormTooLarge, part.FileName(), c.MaxFileSize)
+		}
+
+		form.Files = append(form.Files, jsonFormFile{
+			Name:        part.FormName(),
+			Filename:    part.FileName(),
+			ContentType: part.Header.Get("Content-Type"),
+			Size:        size,
+			SHA256:      hex.EncodeToString(hash.Sum(nil)),
+		})
+	}
+}
+
+func (c FormsConfig) parseURLEncoded(r *http.Request, form *jsonForm) error {
+	// like http.Request.ParseForm, but keeping the order of the fields
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxURLEncodedFormSize+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > maxURLEncodedFormSize {
+		return fmt.Errorf("%w: larger than %d bytes", errFormTooLarge, maxURLEncodedFormSize)
+	}
+
+	for _, pair := range strings.Split(string(body), "&") {
+		if pair == "" {
+			continue
+		}
+		if c.MaxParts > 0 && len(form.Fields) >= c.MaxParts {
+			return fmt.Errorf("%w: more than %d fields", errFormTooLarge, c.MaxParts)
+		}
+
+		name, value, _ := strings.Cut(pair, "=")
+		if name, err = url.QueryUnescape(name); err != nil {
+			return err
+		}
+		if value, err = url.QueryUnescape(value); err != nil {
+			return err
+		}
+		form.Fields = append(form.Fields, jsonFormField{Name: name, Value: value})
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Forwarded is the client address, scheme and host of a request as seen by
+// the first trusted proxy.
+type Forwarded struct {
+	ClientIP string `json:"client_ip"`
+	Scheme   string `json:"scheme"`
+	Host     string `json:"host"`
+}
+
+type forwardedContextKey struct{}
+
+// ForwardedFromRequest returns the values resolved by the middleware of
+// NewForwardedMiddleware, or the ones of the direct connection.
+func ForwardedFromRequest(r *http.Request) Forwarded {
+	if f, ok := r.Context().Value(forwardedContextKey{}).(Forwarded); ok {
+		return f
+	}
+	return directForwarded(r)
+}
+
+func directForwarded(r *http.Request) Forwarded {
+	f := Forwarded{ClientIP: r.RemoteAddr, Scheme: "http", Host: r.Host}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		f.ClientIP = host
+	}
+	if r.TLS != nil {
+		f.Scheme = "https"
+	}
+	return f
+}
+
+// AbsoluteURL returns path as absolute URL using the resolved scheme and
+// host of r.
+func AbsoluteURL(r *http.Request, path string) string {
+	f := ForwardedFromRequest(r)
+	return f.Scheme + "://" + f.Host + path
+}
+
+// NewForwardedMiddleware resolves the client IP, scheme and host from the
+// RFC 7239 Forwarded header, or X-Forwarded-For, X-Forwarded-Proto and
+// X-Forwarded-Host, if the request comes from one of the trusted proxies.
+// The client IP is the last address in the chain not belonging to a trusted
+// proxy. r.RemoteAddr is replaced by it.
+func NewForwardedMiddleware(trusted []*net.IPNet) func(http.Handler) http.Handler {
+	isTrusted := func(addr string) bool {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return false
+		}
+		for _, n := range trusted {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			direct := directForwarded(r)
+			f := direct
+
+			if isTrusted(direct.ClientIP) {
+				hops := forwardedHops(r.Header)
+
+				// walk from the closest proxy towards the client
+				for i := len(hops) - 1; i >= 0; i-- {
+					hop := hops[i]
+					if hop.proto != "" {
+						f.Scheme = strings.ToLower(hop.proto)
+					}
+					if hop.host != "" {
+						f.Host = hop.host
+					}
+					if hop.client != "" {
+						f.ClientIP = hop.client
+					}
+					if !isTrusted(hop.client) {
+						break
+					}
+				}
+
+				if f.ClientIP != direct.ClientIP {
+					r.RemoteAddr = net.JoinHostPort(f.ClientIP, "0")
+				}
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), forwardedContextKey{}, f)))
+		})
+	}
+}
+
+// forwardedHop describes the request received by one proxy.
+type forwardedHop struct {
+	client string
+	proto  string
+	host   string
+}
+
+// forwardedHops returns the hops of the Forwarded header, or the
+// X-Forwarded-* headers if it is missing, client first.
+func forwardedHops(h http.Header) []forwardedHop {
+	if values := h.Values("Forwarded"); len(values) > 0 {
+		var hops []forwardedHop
+		for _, element := range splitHeaderList(values) {
+			var hop forwardedHop
+			for _, pair := range strings.Split(element, ";") {
+				key, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+				if !found {
+					continue
+				}
+				value = strings.Trim(value, `"`)
+
+				switch strings.ToLower(key) {
+				case "for":
+					hop.client = forwardedNodeIP(value)
+				case "proto":
+					hop.proto = value
+				case "host":
+					hop.host = value
+				}
+			}
+			hops = append(hops, hop)
+		}
+		return hops
+	}
+
+	clients := splitHeaderList(h.Values("X-Forwarded-For"))
+	protos := splitHeaderList(h.Values("X-Forwarded-Proto"))
+	hosts := splitHeaderList(h.Values("X-Forwarded-Host"))
+
+	// proxies usually only set proto and host once, applying to the whole
+	// chain, otherwise they are expected to match the clients
+	hops := make([]forwardedHop, len(clients))
+	for i, client := range clients {
+		hops[i].client = forwardedNodeIP(client)
+		hops[i].proto = listValue(protos, i, len(clients))
+		hops[i].host = listValue(hosts, i, len(clients))
+	}
+	if len(hops) == 0 && (len(protos) > 0 || len(hosts) > 0) {
+		hops = append(hops, forwardedHop{proto: listValue(protos, 0, 1), host: listValue(hosts, 0, 1)})
+	}
+	return hops
+}
+
+// listValue returns the i-th of n values, or the first value if the list
+// does not have n entries.
+func listValue(values []string, i, n int) string {
+	if len(values) == n {
+		return values[i]
+	}
+	if len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// forwardedNodeIP returns the IP of a node like 192.0.2.1:4711 or
+// "[2001:db8::1]:4711", or the node itself if it is obfuscated.
+func forwardedNodeIP(node string) string {
+	node = strings.TrimSpace(node)
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+	return strings.Trim(node, "[]")
+}
+
+func splitHeaderList(values []string) []string {
+	var list []string
+	for _, v := range values {
+		for _, element := range strings.Split(v, ",") {
+			if element = strings.TrimSpace(element); element != "" {
+				list = append(list, element)
+			}
+		}
+	}
+	return list
+}
@@ -1,11 +1,13 @@
 package server
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"math/rand"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/stormforger/testapp/internal/randutil"
 )
@@ -25,6 +27,9 @@ func DoNotRespondHandler(w http.ResponseWriter, r *http.Request) {
 	defer conn.Close()
 }
 
+// RespondWithBytesHandler responds with `size` random bytes. The payload is
+// deterministic per `seed`, so it supports range requests. Without seed, a
+// random one is used and returned in the X-Payload-Seed header.
 func RespondWithBytesHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/octet-stream")
 
@@ -33,52 +38,30 @@ func RespondWithBytesHandler(w http.ResponseWriter, r *http.Request) {
 	if sizeParam != "" {
 		var err error
 		size, err = strconv.Atoi(sizeParam)
-		if err != nil {
+		if err != nil || size < 0 {
 			size = 0
 		}
 	}
 
-	w.WriteHeader(http.StatusOK)
-
-	data := make([]byte, size)
-	if _, err := rand.Read(data); err != nil {
-		fmt.Fprintf(w, "Could not generate random response payload")
-	}
-	w.Write(data)
-}
-
-// SetCookieHandler serves a response with a cookie.
-func SetCookieHandler(w http.ResponseWriter, req *http.Request) {
-	cookieName := req.FormValue("cookie")
-	if cookieName == "" {
-		cookieName = "sessionid"
-	}
-
-	value := fmt.Sprintf("%d", randMinMax(1_000_000, 9_000_000))
-
-	http.SetCookie(w, &http.Cookie{
-		Name:  cookieName,
-		Value: value,
-	})
-
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "Cookie served.")
-}
-
-// RequiresCookieHandler serves a forbidden response if no cookie is found. every cookie is accepted.
-func RequiresCookieHandler(w http.ResponseWriter, req *http.Request) {
-	cookieName := req.FormValue("cookie")
-	if cookieName == "" {
-		cookieName = "sessionid"
+	seed := rand.Int63()
+	if seedParam := r.URL.Query().Get("seed"); seedParam != "" {
+		var err error
+		seed, err = strconv.ParseInt(seedParam, 10, 64)
+		if err != nil {
+			http.Error(w, "seed must be a number", http.StatusBadRequest)
+			return
+		}
 	}
 
-	c, err := req.Cookie(cookieName)
-	if err == http.ErrNoCookie {
-		http.Error(w, "cookie required", http.StatusForbidden)
+	data := make([]byte, size)
+	if _, err := rand.New(rand.NewSource(seed)).Read(data); err != nil {
+		http.Error(w, "Could not generate random response payload", http.StatusInternalServerError)
 		return
 	}
 
-	fmt.Fprintf(w, "Hello. Your cookie is %s=%s", c.Name, c.Value)
+	w.Header().Set("X-Payload-Seed", strconv.FormatInt(seed, 10))
+	w.Header().Set("ETag", fmt.Sprintf(`"%d-%d"`, size, seed))
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
 }
 
 // RandomTokenJSON returns a JSON with a new random "token" value for each request.
@@ -38,7 +38,7 @@ func ReadRequestBodyMiddleware(next http.Handler) http.Handler {
 			logrus.Debug("Reading request body")
 			_, err := io.Copy(&buffer, r.Body)
 			if err != nil {
-				http.Error(w, "error reading body", 400)
+				writeBodyError(w, err)
 				return
 			}
 
@@ -48,3 +48,15 @@ func ReadRequestBodyMiddleware(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// TLSResumedMiddleware reports via the X-TLS-Resumed response header whether
+// the TLS session of the connection was resumed.
+func TLSResumedMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			w.Header().Set("X-TLS-Resumed", strconv.FormatBool(r.TLS.DidResume))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
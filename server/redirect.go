@@ -0,0 +1,161 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// RedirectConfig configures the redirect endpoints.
+type RedirectConfig struct {
+	// HTTPPort and HTTPSPort are the ports cross-scheme redirects point to.
+	// HTTPSPort is empty if HTTPS is disabled.
+	HTTPPort  string
+	HTTPSPort string
+}
+
+const maxRedirectHops = 100
+
+var redirectStatusCodes = map[int]bool{
+	http.StatusMovedPermanently:  true,
+	http.StatusFound:             true,
+	http.StatusSeeOther:          true,
+	http.StatusTemporaryRedirect: true,
+	http.StatusPermanentRedirect: true,
+}
+
+// RegisterRedirectRoutes adds the /redirect/{n} endpoint.
+func RegisterRedirectRoutes(r *mux.Router, config RedirectConfig) {
+	r.Path("/redirect/{n:[0-9]+}").HandlerFunc(config.redirectHandler)
+}
+
+// redirectHandler redirects to /redirect/{n-1} until n is 0, then reports the
+// chain of URLs requested, collected in the `via` query parameters. The hops
+// are controlled by the query parameters:
+//
+//   - status: 301, 302 (default), 303, 307 or 308
+//   - target: relative (default) or absolute location
+//   - scheme: http or https, absolute location with the scheme and its port
+//   - loop: true redirects to the same URL forever
+//   - cookies: true sets the cookie `hop-{n}` on each hop
+func (c RedirectConfig) redirectHandler(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.Atoi(mux.Vars(r)["n"])
+	if err != nil || n > maxRedirectHops {
+		http.Error(w, fmt.Sprintf("n must be at most %d", maxRedirectHops), http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+
+	// the chain contains the URLs without the chain itself
+	previous := query["via"]
+	query.Del("via")
+	current := *r.URL
+	current.RawQuery = query.Encode()
+	via := append(previous, AbsoluteURL(r, current.RequestURI()))
+
+	if query.Get("cookies") == "true" {
+		http.SetCookie(w, &http.Cookie{
+			Name:  fmt.Sprintf("hop-%d", n),
+			Value: strconv.Itoa(len(via)),
+			Path:  "/redirect",
+		})
+	}
+
+	loop := query.Get("loop") == "true"
+	if n == 0 && !loop {
+		writeRedirectChain(w, r, via)
+		return
+	}
+
+	status := http.StatusFound
+	if v := query.Get("status"); v != "" {
+		status, err = strconv.Atoi(v)
+		if err != nil || !redirectStatusCodes[status] {
+			http.Error(w, "status must be 301, 302, 303, 307 or 308", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// a loop redirects to the same URL, as its chain would grow forever
+	next := *r.URL
+	if !loop {
+		next.Path = "/redirect/" + strconv.Itoa(n-1)
+		next.RawPath = ""
+		query["via"] = via
+		next.RawQuery = query.Encode()
+	}
+
+	location := next.RequestURI()
+	if scheme := query.Get("scheme"); scheme != "" {
+		location, err = c.crossSchemeURL(r, scheme, location)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else if query.Get("target") == "absolute" {
+		location = AbsoluteURL(r, location)
+	}
+
+	w.Header().Set("Location", location)
+	w.WriteHeader(status)
+}
+
+// crossSchemeURL returns path as absolute URL with scheme, using the host of
+// the request and the port of the scheme.
+func (c RedirectConfig) crossSchemeURL(r *http.Request, scheme, path string) (string, error) {
+	var port string
+	switch scheme {
+	case "http":
+		port = c.HTTPPort
+	case "https":
+		port = c.HTTPSPort
+	default:
+		return "", fmt.Errorf("scheme must be http or https, got %q", scheme)
+	}
+	if port == "" {
+		return "", fmt.Errorf("%s is disabled", scheme)
+	}
+
+	host := ForwardedFromRequest(r).Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	u := url.URL{Scheme: scheme, Host: net.JoinHostPort(host, port)}
+	return u.String() + path, nil
+}
+
+type jsonRedirectChain struct {
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Hops    int               `json:"hops"`
+	Chain   []string          `json:"chain"`
+	Cookies map[string]string `json:"cookies"`
+}
+
+func writeRedirectChain(w http.ResponseWriter, r *http.Request, via []string) {
+	chain := jsonRedirectChain{
+		Method:  r.Method,
+		URL:     via[len(via)-1],
+		Hops:    len(via) - 1,
+		Chain:   via,
+		Cookies: map[string]string{},
+	}
+	for _, c := range r.Cookies() {
+		chain.Cookies[c.Name] = c.Value
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	e.SetEscapeHTML(false)
+	if err := e.Encode(chain); err != nil {
+		logrus.Errorf("json marshal: %v", err)
+	}
+}
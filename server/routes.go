@@ -7,11 +7,15 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-func RegisterX509Routes(r *mux.Router, serverCertificateFile, serverPrivateKeyFile string) {
-	// X.509 and EST routes
+func RegisterX509Routes(r *mux.Router, caCertPEMData, caPrivateKeyPEMData []byte, acmeConfig ACMEConfig) {
+	// X.509, EST and ACME routes
 	// --------------------------------------------------------------------------
-	if serverCertificateFile != "" && serverPrivateKeyFile != "" {
-		err := RegisterX509ESTHandlers(r, serverCertificateFile, serverPrivateKeyFile)
+	if len(caCertPEMData) > 0 && len(caPrivateKeyPEMData) > 0 {
+		err := RegisterX509ESTHandlers(r, caCertPEMData, caPrivateKeyPEMData)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		err = RegisterACMEHandlers(r, caCertPEMData, caPrivateKeyPEMData, acmeConfig)
 		if err != nil {
 			logrus.Fatal(err)
 		}
@@ -20,23 +24,30 @@ func RegisterX509Routes(r *mux.Router, serverCertificateFile, serverPrivateKeyFi
 	}
 }
 
-func RegisterTestAppRoutes(r *mux.Router) {
+func RegisterTestAppRoutes(r *mux.Router, cookies *CookieSigner) {
 	s := r.PathPrefix("/demo").Subrouter()
 	RegisterDemo(s)
 
 	r.PathPrefix("/data/").Handler(http.StripPrefix("/data/", http.FileServer(http.Dir("data/static"))))
 
-	r.Path("/cookie/set").HandlerFunc(SetCookieHandler)
-	r.Path("/cookie/get").HandlerFunc(RequiresCookieHandler)
+	r.Path("/cookie/set").HandlerFunc(cookies.SetCookieHandler)
+	r.Path("/cookie/get").HandlerFunc(cookies.RequiresCookieHandler)
+	r.Path("/cookie/delete").HandlerFunc(DeleteCookieHandler)
+	r.Path("/cookie/jar").HandlerFunc(cookies.CookieJarHandler)
+
+	RegisterCacheRoutes(r)
 }
 
 // RegisterStaticHandler adds mostly deterministic handlers that do not rely on state or local files.
-func RegisterStaticHandler(r *mux.Router) {
+func RegisterStaticHandler(r *mux.Router, echo EchoConfig) {
 	r.HandleFunc("/random/get_token", RandomTokenJSON)
 	r.HandleFunc("/respond-with/bytes", RespondWithBytesHandler)
+	r.HandleFunc("/respond-with/slow", SlowResponseHandler)
 	r.HandleFunc("/do-not-respond", DoNotRespondHandler)
+	r.HandleFunc("/upload", UploadHandler)
 	r.HandleFunc("/x509/inspect", clientCertInspectHandler)
+	r.HandleFunc("/tls/fingerprint", TLSFingerprintHandler)
 
 	// echo handler for everything else
-	r.PathPrefix("/").HandlerFunc(EchoHandler)
+	r.PathPrefix("/").Handler(echo)
 }
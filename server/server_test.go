@@ -1,12 +1,34 @@
 package server_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/andybalholm/brotli"
 	"github.com/gorilla/mux"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stormforger/testapp/internal/conninfo"
 	"github.com/stormforger/testapp/server"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -16,7 +38,7 @@ func TestTestAppHTTPServer(t *testing.T) {
 	require.Nil(t, os.Chdir("..")) // our server package assumes it has access to the `data/` path directly.
 
 	r := mux.NewRouter()
-	server.RegisterStaticHandler(r)
+	server.RegisterStaticHandler(r, server.EchoConfig{MaxBodySize: server.DefaultEchoMaxBodySize})
 
 	s := httptest.NewServer(r)
 
@@ -25,3 +47,846 @@ func TestTestAppHTTPServer(t *testing.T) {
 	defer resp.Body.Close()
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
 }
+
+func TestX509InspectHandler(t *testing.T) {
+	r := mux.NewRouter()
+	server.RegisterStaticHandler(r, server.EchoConfig{MaxBodySize: server.DefaultEchoMaxBodySize})
+
+	s := httptest.NewUnstartedServer(r)
+	s.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	s.StartTLS()
+	defer s.Close()
+
+	// present the server certificate of the test server as client certificate
+	client := s.Client()
+	client.Transport.(*http.Transport).TLSClientConfig.Certificates = s.TLS.Certificates
+
+	resp, err := client.Get(s.URL + "/x509/inspect?pem")
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var inspection struct {
+		Status           string `json:"status"`
+		TLSVersion       string `json:"tls_version"`
+		CipherSuite      string `json:"cipher_suite"`
+		PEM              string `json:"pem"`
+		PeerCertificates []struct {
+			KeyType     string   `json:"key_type"`
+			DNSNames    []string `json:"dns_names"`
+			ExtKeyUsage []string `json:"ext_key_usage"`
+		} `json:"peer_certificates"`
+	}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&inspection))
+
+	assert.Equal(t, "client_cert", inspection.Status)
+	assert.Equal(t, "TLS 1.3", inspection.TLSVersion)
+	assert.Regexp(t, "^TLS_", inspection.CipherSuite)
+	assert.Contains(t, inspection.PEM, "BEGIN CERTIFICATE")
+	require.Len(t, inspection.PeerCertificates, 1)
+	assert.Equal(t, "RSA", inspection.PeerCertificates[0].KeyType)
+	assert.Contains(t, inspection.PeerCertificates[0].DNSNames, "example.com")
+	assert.Contains(t, inspection.PeerCertificates[0].ExtKeyUsage, "server_auth")
+}
+
+func TestVirtualHosts(t *testing.T) {
+	vhosts, err := server.ParseVirtualHosts("api.example.com=/demo,/respond-with; *.example.org=/data")
+	require.Nil(t, err)
+
+	r := mux.NewRouter()
+	r.Use(vhosts.Middleware)
+	server.RegisterStaticHandler(r, server.EchoConfig{MaxBodySize: server.DefaultEchoMaxBodySize})
+
+	cases := []struct {
+		host   string
+		path   string
+		status int
+	}{
+		{"api.example.com", "/respond-with/bytes", http.StatusOK},
+		{"api.example.com:8080", "/demo", http.StatusOK},
+		{"api.example.com", "/demonstration", http.StatusNotFound},
+		{"api.example.com", "/echo", http.StatusNotFound},
+		{"www.example.org", "/data/file", http.StatusOK},
+		{"www.example.org", "/", http.StatusNotFound},
+		{"example.net", "/echo", http.StatusOK},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, "http://"+c.host+c.path, nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, c.status, w.Code, c.host+c.path)
+	}
+
+	_, err = server.ParseVirtualHosts("api.example.com=demo")
+	assert.NotNil(t, err)
+}
+
+func TestEchoHandlerJSON(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/some/path?format=json", strings.NewReader("hello"))
+	req.Header.Set("X-Test", "value")
+	w := httptest.NewRecorder()
+	server.EchoHandler(w, req)
+
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var echo struct {
+		Method  string              `json:"method"`
+		URL     string              `json:"url"`
+		Headers map[string][]string `json:"headers"`
+		Body    string              `json:"body"`
+	}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &echo))
+	assert.Equal(t, http.MethodPost, echo.Method)
+	assert.Equal(t, "/some/path?format=json", echo.URL)
+	assert.Equal(t, []string{"value"}, echo.Headers["X-Test"])
+	assert.Equal(t, "hello", echo.Body)
+}
+
+func TestForwardedMiddleware(t *testing.T) {
+	_, trusted, err := net.ParseCIDR("10.0.0.0/8")
+	require.Nil(t, err)
+
+	var resolved server.Forwarded
+	handler := server.NewForwardedMiddleware([]*net.IPNet{trusted})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resolved = server.ForwardedFromRequest(r)
+	}))
+
+	cases := []struct {
+		remoteAddr string
+		header     http.Header
+		expected   server.Forwarded
+	}{
+		{"10.0.0.1:1234", http.Header{
+			"X-Forwarded-For":   {"203.0.113.7, 10.1.1.1"},
+			"X-Forwarded-Proto": {"https"},
+			"X-Forwarded-Host":  {"shop.example.com"},
+		}, server.Forwarded{ClientIP: "203.0.113.7", Scheme: "https", Host: "shop.example.com"}},
+		{"10.0.0.1:1234", http.Header{
+			"Forwarded": {`for=198.51.100.1;proto=http, for="[2001:db8::1]:4711";proto=https;host=a.example`},
+		}, server.Forwarded{ClientIP: "2001:db8::1", Scheme: "https", Host: "a.example"}},
+		{"192.0.2.1:1234", http.Header{
+			"X-Forwarded-For":   {"203.0.113.7"},
+			"X-Forwarded-Proto": {"https"},
+		}, server.Forwarded{ClientIP: "192.0.2.1", Scheme: "http", Host: "testapp.example"}},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, "http://testapp.example/", nil)
+		req.RemoteAddr = c.remoteAddr
+		req.Header = c.header
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		assert.Equal(t, c.expected, resolved)
+	}
+}
+
+func TestSlowResponseHandler(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(server.SlowResponseHandler))
+	defer s.Close()
+
+	for _, mode := range []string{"body", "headers"} {
+		resp, err := http.Get(s.URL + "?mode=" + mode + "&size=10&chunk=4&interval=1&headers=2")
+		require.Nil(t, err)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.Nil(t, err)
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode, mode)
+		assert.Len(t, body, 10, mode)
+		if mode == "headers" {
+			assert.NotEmpty(t, resp.Header.Get("X-Slow-Header-1"))
+		}
+	}
+}
+
+func TestSlowResponseWriteTimeout(t *testing.T) {
+	s := httptest.NewUnstartedServer(http.HandlerFunc(server.SlowResponseHandler))
+	s.Config.WriteTimeout = 200 * time.Millisecond
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	defer s.Close()
+
+	// via HTTP/1.1 the connection is taken over, via HTTP/2 the body must be
+	// sent within the write timeout
+	http1 := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	get := func(client *http.Client, interval int) (*http.Response, []byte) {
+		resp, err := client.Get(fmt.Sprintf("%s?size=10&chunk=1&interval=%d", s.URL, interval))
+		require.Nil(t, err)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.Nil(t, err, resp.Proto)
+		return resp, body
+	}
+
+	start := time.Now()
+	resp, body := get(http1, 50)
+	assert.Equal(t, 1, resp.ProtoMajor)
+	assert.Len(t, body, 10)
+	assert.Greater(t, time.Since(start), 500*time.Millisecond)
+
+	resp, _ = get(s.Client(), 50)
+	assert.Equal(t, 2, resp.ProtoMajor)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, body = get(s.Client(), 10)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Len(t, body, 10)
+}
+
+func TestSlowResponseStall(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(server.SlowResponseHandler))
+	defer s.Close()
+
+	resp, err := http.Get(s.URL + "?mode=stall&timeout=301")
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	require.Nil(t, err)
+	defer conn.Close()
+	start := time.Now()
+	_, err = conn.Write([]byte("GET /?mode=stall&timeout=1 HTTP/1.1\r\nHost: testapp\r\n\r\n"))
+	require.Nil(t, err)
+	stalled, err := io.ReadAll(conn)
+	require.Nil(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", string(stalled))
+	assert.Greater(t, time.Since(start), 900*time.Millisecond)
+}
+
+func TestConnectionMiddleware(t *testing.T) {
+	s := httptest.NewUnstartedServer(server.NewConnectionMiddleware(3)(http.HandlerFunc(server.EchoHandler)))
+	s.Config.ConnContext = conninfo.ConnContext
+	s.Start()
+	defer s.Close()
+
+	get := func(query string) *http.Response {
+		resp, err := http.Get(s.URL + "/?" + query)
+		require.Nil(t, err)
+		_, err = io.ReadAll(resp.Body)
+		require.Nil(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	first := get("")
+	assert.Equal(t, "1", first.Header.Get("X-Connection-Request"))
+	second := get("")
+	assert.Equal(t, first.Header.Get("X-Connection-Id"), second.Header.Get("X-Connection-Id"))
+	assert.Equal(t, "2", second.Header.Get("X-Connection-Request"))
+
+	// max requests reached
+	assert.True(t, get("").Close)
+	assert.Equal(t, "1", get("").Header.Get("X-Connection-Request"))
+
+	assert.True(t, get("connection=close").Close)
+
+	dropped := get("connection=drop")
+	assert.False(t, dropped.Close)
+	assert.Equal(t, http.StatusOK, dropped.StatusCode)
+	assert.NotEqual(t, dropped.Header.Get("X-Connection-Id"), get("").Header.Get("X-Connection-Id"))
+}
+
+func TestConnectionDropStreaming(t *testing.T) {
+	release := make(chan struct{})
+	handlers := http.NewServeMux()
+	handlers.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte("second"))
+	})
+	handlers.HandleFunc("/slow", server.SlowResponseHandler)
+	s := httptest.NewUnstartedServer(server.NewConnectionMiddleware(0)(handlers))
+	s.Config.ConnContext = conninfo.ConnContext
+	s.Start()
+	defer s.Close()
+
+	// the response is sent while the handler runs
+	resp, err := http.Get(s.URL + "/stream?connection=drop")
+	require.Nil(t, err)
+	assert.False(t, resp.Close)
+	first := make([]byte, 5)
+	_, err = io.ReadFull(resp.Body, first)
+	require.Nil(t, err)
+	assert.Equal(t, "first", string(first))
+	close(release)
+	rest, err := io.ReadAll(resp.Body)
+	require.Nil(t, err)
+	assert.Equal(t, "second", string(rest))
+	resp.Body.Close()
+
+	// handlers can still take over the connection
+	for _, mode := range []string{"body", "headers"} {
+		resp, err = http.Get(s.URL + "/slow?connection=drop&size=10&interval=1&mode=" + mode)
+		require.Nil(t, err)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.Nil(t, err)
+		assert.Len(t, body, 10, mode)
+	}
+}
+
+func TestCookies(t *testing.T) {
+	r := mux.NewRouter()
+	server.RegisterTestAppRoutes(r, server.NewCookieSigner([]byte("secret")))
+	server.RegisterStaticHandler(r, server.EchoConfig{MaxBodySize: server.DefaultEchoMaxBodySize})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/cookie/set?cookie=a&cookie=b=fixed&path=/&max-age=60&samesite=strict&httponly=true&partitioned=true", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	setCookies := w.Header().Values("Set-Cookie")
+	require.Len(t, setCookies, 2)
+	assert.Contains(t, setCookies[1], "b=fixed; Path=/; Max-Age=60; HttpOnly; SameSite=Strict; Partitioned")
+
+	cookies := w.Result().Cookies()
+	issued := cookies[0].Value
+
+	get := func(cookie, query string) int {
+		req := httptest.NewRequest(http.MethodGet, "/cookie/get?"+query, nil)
+		req.Header.Set("Cookie", cookie)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusOK, get("sessionid=forged", ""))
+	assert.Equal(t, http.StatusForbidden, get("sessionid=forged", "verify=true"))
+	assert.Equal(t, http.StatusOK, get("a="+issued, "cookie=a&verify=true"))
+
+	// values are accepted by every instance sharing the secret
+	other := mux.NewRouter()
+	server.RegisterTestAppRoutes(other, server.NewCookieSigner([]byte("secret")))
+	req := httptest.NewRequest(http.MethodGet, "/cookie/get?cookie=a&verify=true", nil)
+	req.Header.Set("Cookie", "a="+issued)
+	w = httptest.NewRecorder()
+	other.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	other = mux.NewRouter()
+	server.RegisterTestAppRoutes(other, server.NewCookieSigner(nil))
+	w = httptest.NewRecorder()
+	other.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, http.StatusOK, get("b=fixed", "cookie=b&value=fixed"))
+	assert.Equal(t, http.StatusForbidden, get("b=other", "cookie=b&value=fixed"))
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/cookie/delete?cookie=a", nil))
+	assert.Equal(t, "a=; Expires=Thu, 01 Jan 1970 00:00:00 GMT; Max-Age=0", w.Header().Get("Set-Cookie"))
+}
+
+func TestSessions(t *testing.T) {
+	r := mux.NewRouter()
+	server.RegisterSessionRoutes(r, server.NewSessionStore([]byte("secret")))
+
+	do := func(path, cookie string) (*httptest.ResponseRecorder, string) {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if cookie != "" {
+			req.Header.Set("Cookie", "session="+cookie)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		var body struct {
+			Error string `json:"error"`
+		}
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &body))
+		return w, body.Error
+	}
+	reason := func(path, cookie string) string {
+		w, reason := do(path, cookie)
+		if reason != "" {
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		}
+		return reason
+	}
+
+	w, _ := do("/cookie/login", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	session := w.Result().Cookies()[0].Value
+
+	assert.Equal(t, "", reason("/cookie/session", session))
+	assert.Equal(t, "missing", reason("/cookie/session", ""))
+	assert.Equal(t, "invalid", reason("/cookie/session", session+"0"))
+
+	id, _, _ := strings.Cut(session, ".")
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(id + ".1"))
+	assert.Equal(t, "expired", reason("/cookie/session", id+".1."+hex.EncodeToString(mac.Sum(nil))))
+
+	w, _ = do("/cookie/refresh", session)
+	require.Equal(t, http.StatusOK, w.Code)
+	refreshed := w.Result().Cookies()[0].Value
+
+	assert.Equal(t, "", reason("/cookie/logout", refreshed))
+	assert.Equal(t, "revoked", reason("/cookie/session", session))
+	assert.Equal(t, "revoked", reason("/cookie/session", refreshed))
+
+	// logging out with an older cookie revokes the refreshed one beyond the
+	// expiry of the older cookie
+	w, _ = do("/cookie/login?ttl=1s", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	session = w.Result().Cookies()[0].Value
+	w, _ = do("/cookie/refresh", session)
+	require.Equal(t, http.StatusOK, w.Code)
+	refreshed = w.Result().Cookies()[0].Value
+
+	assert.Equal(t, "", reason("/cookie/logout", session))
+	time.Sleep(1100 * time.Millisecond)
+	assert.Equal(t, "expired", reason("/cookie/session", session))
+	assert.Equal(t, "revoked", reason("/cookie/session", refreshed))
+}
+
+func TestRedirect(t *testing.T) {
+	r := mux.NewRouter()
+	server.RegisterRedirectRoutes(r, server.RedirectConfig{})
+	s := httptest.NewServer(r)
+	defer s.Close()
+
+	jar, err := cookiejar.New(nil)
+	require.Nil(t, err)
+	client := &http.Client{Jar: jar}
+
+	resp, err := client.Post(s.URL+"/redirect/3?status=307&cookies=true", "text/plain", strings.NewReader("body"))
+	require.Nil(t, err)
+	defer resp.Body.Close()
+
+	var chain struct {
+		Method  string            `json:"method"`
+		Hops    int               `json:"hops"`
+		Chain   []string          `json:"chain"`
+		Cookies map[string]string `json:"cookies"`
+	}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&chain))
+	assert.Equal(t, http.MethodPost, chain.Method)
+	assert.Equal(t, 3, chain.Hops)
+	require.Len(t, chain.Chain, 4)
+	assert.Equal(t, s.URL+"/redirect/3?cookies=true&status=307", chain.Chain[0])
+	assert.Equal(t, map[string]string{"hop-3": "1", "hop-2": "2", "hop-1": "3"}, chain.Cookies)
+
+	_, err = client.Get(s.URL + "/redirect/1?loop=true")
+	assert.ErrorContains(t, err, "stopped after 10 redirects")
+}
+
+func TestCache(t *testing.T) {
+	r := mux.NewRouter()
+	server.RegisterCacheRoutes(r)
+
+	get := func(path string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	first := get("/cache/key?vary=Accept-Language&cache-control=max-age=10", http.Header{"Accept-Language": {"de"}})
+	require.Equal(t, http.StatusOK, first.Code)
+	assert.Equal(t, "max-age=10", first.Header().Get("Cache-Control"))
+	assert.Equal(t, "Accept-Language", first.Header().Get("Vary"))
+	assert.Equal(t, "1", first.Header().Get("X-Origin-Hits"))
+	etag := first.Header().Get("ETag")
+	require.NotEmpty(t, etag)
+
+	revalidated := get("/cache/key?vary=Accept-Language", http.Header{"Accept-Language": {"de"}, "If-None-Match": {etag}})
+	assert.Equal(t, http.StatusNotModified, revalidated.Code)
+	assert.Equal(t, "2", revalidated.Header().Get("X-Origin-Hits"))
+
+	other := get("/cache/key?vary=Accept-Language", http.Header{"Accept-Language": {"en"}, "If-None-Match": {etag}})
+	assert.Equal(t, http.StatusOK, other.Code)
+
+	assert.True(t, strings.HasPrefix(get("/cache/weak?etag=weak", nil).Header().Get("ETag"), `W/"`))
+
+	var stats []struct {
+		Key         string `json:"key"`
+		Hits        int    `json:"hits"`
+		NotModified int    `json:"not_modified"`
+	}
+	require.Nil(t, json.Unmarshal(get("/cache/stats", nil).Body.Bytes(), &stats))
+	require.Len(t, stats, 2)
+	assert.Equal(t, "key", stats[0].Key)
+	assert.Equal(t, 3, stats[0].Hits)
+	assert.Equal(t, 1, stats[0].NotModified)
+}
+
+func TestCacheCompressed(t *testing.T) {
+	r := mux.NewRouter()
+	r.Use(server.NewCompressMiddleware(0))
+	server.RegisterCacheRoutes(r)
+
+	get := func(header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/cache/key?etag=strong", nil)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	plain := get(nil)
+	require.Equal(t, http.StatusOK, plain.Code)
+	etag := plain.Header().Get("ETag")
+	require.True(t, strings.HasPrefix(etag, `"`), etag)
+
+	// the compressed representation has its own strong ETag
+	compressed := get(http.Header{"Accept-Encoding": {"br"}})
+	require.Equal(t, http.StatusOK, compressed.Code)
+	assert.Equal(t, "br", compressed.Header().Get("Content-Encoding"))
+	brETag := compressed.Header().Get("ETag")
+	assert.Equal(t, strings.TrimSuffix(etag, `"`)+`-br"`, brETag)
+
+	revalidated := get(http.Header{"Accept-Encoding": {"br"}, "If-None-Match": {brETag}})
+	assert.Equal(t, http.StatusNotModified, revalidated.Code)
+	assert.Equal(t, brETag, revalidated.Header().Get("ETag"))
+
+	revalidated = get(http.Header{"If-None-Match": {etag}})
+	assert.Equal(t, http.StatusNotModified, revalidated.Code)
+	assert.Equal(t, etag, revalidated.Header().Get("ETag"))
+
+	assert.Equal(t, http.StatusOK, get(http.Header{"If-None-Match": {brETag}}).Code)
+	assert.Equal(t, http.StatusOK, get(http.Header{"Accept-Encoding": {"gzip"}, "If-None-Match": {brETag}}).Code)
+}
+
+func TestRespondWithBytesRange(t *testing.T) {
+	get := func(header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/respond-with/bytes?size=100&seed=42", nil)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		w := httptest.NewRecorder()
+		server.RespondWithBytesHandler(w, req)
+		return w
+	}
+
+	full := get(nil)
+	require.Equal(t, http.StatusOK, full.Code)
+	require.Equal(t, 100, full.Body.Len())
+	assert.Equal(t, full.Body.Bytes(), get(nil).Body.Bytes())
+
+	partial := get(http.Header{"Range": {"bytes=10-19"}})
+	assert.Equal(t, http.StatusPartialContent, partial.Code)
+	assert.Equal(t, "bytes 10-19/100", partial.Header().Get("Content-Range"))
+	assert.Equal(t, full.Body.Bytes()[10:20], partial.Body.Bytes())
+
+	assert.True(t, strings.HasPrefix(get(http.Header{"Range": {"bytes=0-1,5-6"}}).Header().Get("Content-Type"), "multipart/byteranges"))
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, get(http.Header{"Range": {"bytes=100-"}}).Code)
+	assert.Equal(t, http.StatusOK, get(http.Header{"Range": {"bytes=0-1"}, "If-Range": {`"100-1"`}}).Code)
+}
+
+func TestCompressMiddleware(t *testing.T) {
+	body := strings.Repeat("compressible ", 100)
+	handler := server.NewCompressMiddleware(100)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("small") {
+			w.Write([]byte("small"))
+			return
+		}
+		w.Write([]byte(body))
+	}))
+
+	get := func(query, acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/?"+query, nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	decoders := map[string]func(io.Reader) (io.Reader, error){
+		"br":      func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+		"zstd":    func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) },
+		"gzip":    func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		"deflate": func(r io.Reader) (io.Reader, error) { return zlib.NewReader(r) },
+	}
+	for encoding, decoder := range decoders {
+		w := get("", encoding)
+		assert.Equal(t, encoding, w.Header().Get("Content-Encoding"))
+		assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+
+		r, err := decoder(w.Body)
+		require.Nil(t, err, encoding)
+		decoded, err := io.ReadAll(r)
+		require.Nil(t, err, encoding)
+		assert.Equal(t, body, string(decoded), encoding)
+	}
+
+	assert.Equal(t, "gzip", get("", "gzip;q=0.9, br;q=0.5, zstd;q=0").Header().Get("Content-Encoding"))
+	assert.Equal(t, "", get("", "identity").Header().Get("Content-Encoding"))
+	assert.Equal(t, "", get("compress=none", "gzip").Header().Get("Content-Encoding"))
+	assert.Equal(t, "", get("small", "gzip").Header().Get("Content-Encoding"))
+	assert.Equal(t, "zstd", get("small&compress=zstd", "").Header().Get("Content-Encoding"))
+
+	mislabeled := get("compress-error=mislabel", "gzip")
+	assert.Equal(t, "gzip", mislabeled.Header().Get("Content-Encoding"))
+	assert.Equal(t, body, mislabeled.Body.String())
+
+	for _, mode := range []string{"corrupt", "truncate"} {
+		r, err := gzip.NewReader(get("compress-error="+mode, "gzip").Body)
+		if err == nil {
+			_, err = io.ReadAll(r)
+		}
+		assert.NotNil(t, err, mode)
+	}
+	assert.Equal(t, http.StatusBadRequest, get("compress-error=corrupt&compress=none", "gzip").Code)
+	assert.Equal(t, http.StatusBadRequest, get("compress-error=corrupt", "identity").Code)
+
+	// uncompressed paths only skip negotiated compression
+	for query, status := range map[string]int{"": http.StatusOK, "compress=none": http.StatusOK, "compress=br": http.StatusBadRequest,
+		"compress-error=mislabel": http.StatusBadRequest, "compress=invalid": http.StatusBadRequest} {
+		req := httptest.NewRequest(http.MethodGet, "/respond-with/bytes?"+query, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		assert.Equal(t, status, w.Code, query)
+		assert.Equal(t, "", w.Header().Get("Content-Encoding"), query)
+	}
+
+	// multipart/byteranges responses have no Content-Range header
+	ranges := server.NewCompressMiddleware(0)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(body))
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("Range", "bytes=0-1,5-6")
+	w := httptest.NewRecorder()
+	ranges.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+}
+
+func TestRequestBodyMiddleware(t *testing.T) {
+	handler := server.NewRequestBodyMiddleware(1000)(http.HandlerFunc(server.UploadHandler))
+
+	upload := func(body io.Reader, contentEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/upload", body)
+		req.Header.Set("Content-Encoding", contentEncoding)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte(strings.Repeat("a", 1000)))
+	gz.Close()
+
+	w := upload(bytes.NewReader(compressed.Bytes()), "gzip")
+	require.Equal(t, http.StatusOK, w.Code)
+	var result struct {
+		Bytes         int64  `json:"bytes"`
+		ReceivedBytes int64  `json:"received_bytes"`
+		SHA256        string `json:"sha256"`
+	}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(t, int64(1000), result.Bytes)
+	assert.Equal(t, int64(compressed.Len()), result.ReceivedBytes)
+	sum := sha256.Sum256([]byte(strings.Repeat("a", 1000)))
+	assert.Equal(t, hex.EncodeToString(sum[:]), result.SHA256)
+
+	compressed.Reset()
+	gz.Reset(&compressed)
+	gz.Write([]byte(strings.Repeat("a", 1001)))
+	gz.Close()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, upload(bytes.NewReader(compressed.Bytes()), "gzip").Code)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, upload(strings.NewReader(strings.Repeat("a", 1001)), "").Code)
+	assert.Equal(t, http.StatusUnsupportedMediaType, upload(strings.NewReader("a"), "compress").Code)
+
+	// decompression bombs are rejected without size limit
+	handler = server.NewRequestBodyMiddleware(0)(http.HandlerFunc(server.UploadHandler))
+	compressed.Reset()
+	gz.Reset(&compressed)
+	gz.Write(make([]byte, 4<<20))
+	gz.Close()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, upload(bytes.NewReader(compressed.Bytes()), "gzip").Code)
+}
+
+func TestFormsInspect(t *testing.T) {
+	r := mux.NewRouter()
+	server.RegisterFormRoutes(r, server.FormsConfig{MaxParts: 3, MaxFileSize: 10})
+
+	inspect := func(contentType string, body io.Reader) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/forms/inspect", body)
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	multipartForm := func(fields int, file string) (string, io.Reader) {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		for i := 0; i < fields; i++ {
+			mw.WriteField("field", strconv.Itoa(i))
+		}
+		fw, err := mw.CreateFormFile("file", "hello.txt")
+		require.Nil(t, err)
+		fw.Write([]byte(file))
+		require.Nil(t, mw.Close())
+		return mw.FormDataContentType(), &body
+	}
+
+	var form struct {
+		Fields []struct {
+			Name  string `json:"name"`
+			Value string `json:"value"`
+		} `json:"fields"`
+		Files []struct {
+			Name     string `json:"name"`
+			Filename string `json:"filename"`
+			Size     int64  `json:"size"`
+			SHA256   string `json:"sha256"`
+		} `json:"files"`
+	}
+	w := inspect(multipartForm(2, "hello"))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &form))
+	require.Len(t, form.Fields, 2)
+	assert.Equal(t, "1", form.Fields[1].Value)
+	require.Len(t, form.Files, 1)
+	assert.Equal(t, "hello.txt", form.Files[0].Filename)
+	assert.Equal(t, int64(5), form.Files[0].Size)
+	sum := sha256.Sum256([]byte("hello"))
+	assert.Equal(t, hex.EncodeToString(sum[:]), form.Files[0].SHA256)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, inspect(multipartForm(3, "hello")).Code)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, inspect(multipartForm(0, "hello world")).Code)
+
+	w = inspect("application/x-www-form-urlencoded", strings.NewReader("b=1&a=x+y"))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &form))
+	require.Len(t, form.Fields, 2)
+	assert.Equal(t, "b", form.Fields[0].Name)
+	assert.Equal(t, "x y", form.Fields[1].Value)
+
+	assert.Equal(t, http.StatusUnsupportedMediaType, inspect("text/plain", strings.NewReader("")).Code)
+}
+
+func TestEchoBodyTruncation(t *testing.T) {
+	echo := server.EchoConfig{MaxBodySize: 10}
+	body := strings.Repeat("a", 25)
+	sum := sha256.Sum256([]byte(body))
+
+	w := httptest.NewRecorder()
+	echo.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+	assert.Equal(t, "25", w.Header().Get("X-Echo-Body-Size"))
+	assert.Equal(t, hex.EncodeToString(sum[:]), w.Header().Get("X-Echo-Body-SHA256"))
+	assert.True(t, strings.HasSuffix(w.Body.String(), "\r\n\r\naaaaaaaaaa\n[truncated: 10 of 25 bytes shown]\n"), w.Body.String())
+
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/?stream=true", strings.NewReader(body))
+	req.Header.Set("Content-Type", "text/csv")
+	echo.ServeHTTP(w, req)
+	assert.Equal(t, "text/csv", w.Header().Get("Content-Type"))
+	assert.Equal(t, body, w.Body.String())
+	assert.Equal(t, hex.EncodeToString(sum[:]), w.Header().Get("X-Echo-Body-SHA256"))
+}
+
+func TestStreamEchoHTTP2(t *testing.T) {
+	srv := httptest.NewUnstartedServer(server.EchoConfig{})
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/?stream=true", pr)
+	require.Nil(t, err)
+	go pw.Write([]byte("hello "))
+	resp, err := srv.Client().Do(req)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 2, resp.ProtoMajor)
+
+	// the first chunk is echoed before the request body is complete
+	buf := make([]byte, 6)
+	_, err = io.ReadFull(resp.Body, buf)
+	require.Nil(t, err)
+	assert.Equal(t, "hello ", string(buf))
+
+	pw.Write([]byte("world"))
+	pw.Close()
+	rest, err := io.ReadAll(resp.Body)
+	require.Nil(t, err)
+	assert.Equal(t, "world", string(rest))
+	assert.Equal(t, "11", resp.Trailer.Get("X-Echo-Body-Size"))
+}
+
+func TestLoadAuthUsers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	require.Nil(t, os.WriteFile(path, []byte("# users\nalice:s3cret\n\nbob:other\n"), 0o600))
+	users, err := server.LoadAuthUsers(path)
+	require.Nil(t, err)
+	assert.Equal(t, server.AuthUsers{"alice": "s3cret", "bob": "other"}, users)
+
+	require.Nil(t, os.WriteFile(path, []byte("alice:s3cret\nbob:s3cret\n"), 0o600))
+	_, err = server.LoadAuthUsers(path)
+	assert.EqualError(t, err, path+`:2: user "bob" has the same password as "alice"`)
+}
+
+func TestAuth(t *testing.T) {
+	r := mux.NewRouter()
+	server.RegisterAuthRoutes(r, server.AuthUsers{"alice": "s3cret"})
+
+	do := func(req *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/auth/basic/user/pass", nil)
+	w := do(req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, `Basic realm="testapp", charset="UTF-8"`, w.Header().Get("WWW-Authenticate"))
+	req.SetBasicAuth("user", "pass")
+	assert.Equal(t, http.StatusOK, do(req).Code)
+	req.SetBasicAuth("user", "wrong")
+	assert.Equal(t, http.StatusUnauthorized, do(req).Code)
+	req = httptest.NewRequest(http.MethodGet, "/auth/basic", nil)
+	req.SetBasicAuth("alice", "s3cret")
+	assert.Equal(t, http.StatusOK, do(req).Code)
+
+	uri := "/auth/digest/auth/user/pass"
+	w = do(httptest.NewRequest(http.MethodGet, uri, nil))
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	challenge := w.Header().Get("WWW-Authenticate")
+	params := map[string]string{}
+	for _, m := range regexp.MustCompile(`(\w+)="([^"]*)"`).FindAllStringSubmatch(challenge, -1) {
+		params[m[1]] = m[2]
+	}
+	md5Hex := func(s string) string {
+		sum := md5.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	digest := func(password string) string {
+		ha1 := md5Hex("user:testapp:" + password)
+		ha2 := md5Hex("GET:" + uri)
+		response := md5Hex(ha1 + ":" + params["nonce"] + ":00000001:abcdef:auth:" + ha2)
+		return fmt.Sprintf(`Digest username="user", realm="testapp", nonce="%s", uri="%s", qop=auth, nc=00000001, cnonce="abcdef", response="%s", opaque="%s"`,
+			params["nonce"], uri, response, params["opaque"])
+	}
+	req = httptest.NewRequest(http.MethodGet, uri, nil)
+	req.Header.Set("Authorization", digest("pass"))
+	assert.Equal(t, http.StatusOK, do(req).Code)
+	req.Header.Set("Authorization", digest("wrong"))
+	assert.Equal(t, http.StatusUnauthorized, do(req).Code)
+	// the uri is compared with the request-target as sent
+	uri = "/auth/digest/auth/user/pa{ss"
+	req = httptest.NewRequest(http.MethodGet, uri, nil)
+	req.Header.Set("Authorization", digest("pa{ss"))
+	assert.Equal(t, http.StatusOK, do(req).Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/auth/bearer", nil)
+	assert.Equal(t, `Bearer realm="testapp"`, do(req).Header().Get("WWW-Authenticate"))
+	req.Header.Set("Authorization", "Bearer s3cret")
+	w = do(req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"user": "alice"`)
+	req.Header.Set("Authorization", "Bearer wrong")
+	assert.Equal(t, http.StatusUnauthorized, do(req).Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/auth/apikey?token=key", nil)
+	assert.Equal(t, http.StatusUnauthorized, do(req).Code)
+	req.Header.Set("X-API-Key", "key")
+	assert.Equal(t, http.StatusOK, do(req).Code)
+	assert.Equal(t, http.StatusOK, do(httptest.NewRequest(http.MethodGet, "/auth/apikey?api_key=s3cret", nil)).Code)
+}
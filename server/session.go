@@ -0,0 +1,286 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	sessionCookieName = "session"
+	defaultSessionTTL = time.Hour
+)
+
+// Reasons a session is rejected.
+var (
+	errSessionMissing = errors.New("missing")
+	errSessionInvalid = errors.New("invalid")
+	errSessionExpired = errors.New("expired")
+	errSessionRevoked = errors.New("revoked")
+)
+
+// Session is a session issued by a SessionStore.
+type Session struct {
+	ID      string    `json:"id"`
+	Expires time.Time `json:"expires"`
+}
+
+// SessionStore issues HMAC signed session cookies. Sessions are not stored,
+// only the latest expiry of refreshed sessions and the sessions ended by
+// logout are remembered until they expire.
+type SessionStore struct {
+	secret []byte
+
+	mu        sync.Mutex
+	refreshed map[string]time.Time
+	revoked   map[string]time.Time
+	lastPrune time.Time
+}
+
+// NewSessionStore returns a store signing sessions with secret, or a random
+// secret if it is empty.
+func NewSessionStore(secret []byte) *SessionStore {
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			logrus.Fatalf("generating session secret: %v", err)
+		}
+	}
+	return &SessionStore{
+		secret:    secret,
+		refreshed: map[string]time.Time{},
+		revoked:   map[string]time.Time{},
+		lastPrune: time.Now(),
+	}
+}
+
+// RegisterSessionRoutes adds the session endpoints below /cookie.
+func RegisterSessionRoutes(r *mux.Router, store *SessionStore) {
+	r.Path("/cookie/login").HandlerFunc(store.loginHandler)
+	r.Path("/cookie/session").HandlerFunc(store.sessionHandler)
+	r.Path("/cookie/refresh").HandlerFunc(store.refreshHandler)
+	r.Path("/cookie/logout").HandlerFunc(store.logoutHandler)
+}
+
+// token returns the cookie value of session, `<id>.<expires>.<signature>`.
+func (s *SessionStore) token(session Session) string {
+	payload := session.ID + "." + strconv.FormatInt(session.Expires.Unix(), 10)
+	return payload + "." + s.sign(payload)
+}
+
+func (s *SessionStore) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Validate returns the session of the session cookie of r, or the reason it
+// is rejected.
+func (s *SessionStore) Validate(r *http.Request) (Session, error) {
+	c, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return Session{}, errSessionMissing
+	}
+
+	parts := strings.Split(c.Value, ".")
+	if len(parts) != 3 {
+		return Session{}, errSessionInvalid
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(s.sign(parts[0]+"."+parts[1]))) {
+		return Session{}, errSessionInvalid
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return Session{}, errSessionInvalid
+	}
+
+	session := Session{ID: parts[0], Expires: time.Unix(expires, 0).UTC()}
+	if time.Now().After(session.Expires) {
+		return session, errSessionExpired
+	}
+
+	s.mu.Lock()
+	revokedUntil, revoked := s.revoked[session.ID]
+	s.mu.Unlock()
+	if revoked && !time.Now().After(revokedUntil) {
+		return session, errSessionRevoked
+	}
+
+	return session, nil
+}
+
+// refresh remembers the latest expiry issued for the session, as cookies
+// with earlier expiries of the same session stay valid.
+func (s *SessionStore) refresh(old, session Session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneLocked()
+
+	expires := s.refreshed[session.ID]
+	for _, e := range []time.Time{old.Expires, session.Expires} {
+		if e.After(expires) {
+			expires = e
+		}
+	}
+	s.refreshed[session.ID] = expires
+}
+
+// revoke remembers session as ended until all cookies issued for it expire.
+func (s *SessionStore) revoke(session Session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneLocked()
+
+	expires := session.Expires
+	if refreshed, exists := s.refreshed[session.ID]; exists && refreshed.After(expires) {
+		expires = refreshed
+	}
+	delete(s.refreshed, session.ID)
+	s.revoked[session.ID] = expires
+}
+
+// pruneLocked removes sessions once they have expired, at most once a
+// minute.
+func (s *SessionStore) pruneLocked() {
+	now := time.Now()
+	if now.Sub(s.lastPrune) < time.Minute {
+		return
+	}
+	s.lastPrune = now
+
+	for _, m := range []map[string]time.Time{s.refreshed, s.revoked} {
+		for id, expires := range m {
+			if now.After(expires) {
+				delete(m, id)
+			}
+		}
+	}
+}
+
+// issue sets the session cookie for session.
+func (s *SessionStore) issue(w http.ResponseWriter, r *http.Request, session Session) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    s.token(session),
+		Path:     "/",
+		Expires:  session.Expires,
+		Secure:   ForwardedFromRequest(r).Scheme == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// sessionTTL returns the `ttl` query parameter of r.
+func sessionTTL(r *http.Request) (time.Duration, error) {
+	v := r.URL.Query().Get("ttl")
+	if v == "" {
+		return defaultSessionTTL, nil
+	}
+	ttl, err := time.ParseDuration(v)
+	if err != nil || ttl <= 0 {
+		return 0, errors.New("ttl must be a positive duration")
+	}
+	return ttl, nil
+}
+
+// loginHandler starts a new session, valid for the `ttl` query parameter
+// (default 1h).
+func (s *SessionStore) loginHandler(w http.ResponseWriter, r *http.Request) {
+	ttl, err := sessionTTL(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		http.Error(w, "could not generate session", http.StatusInternalServerError)
+		return
+	}
+
+	session := Session{ID: hex.EncodeToString(id), Expires: time.Now().Add(ttl).UTC().Truncate(time.Second)}
+	s.issue(w, r, session)
+	writeSessionJSON(w, http.StatusOK, session, nil)
+}
+
+// sessionHandler responds with the session, or 401 if it is missing,
+// invalid, expired or revoked.
+func (s *SessionStore) sessionHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := s.Validate(r)
+	if err != nil {
+		writeSessionJSON(w, http.StatusUnauthorized, session, err)
+		return
+	}
+	writeSessionJSON(w, http.StatusOK, session, nil)
+}
+
+// refreshHandler extends a valid session by the `ttl` query parameter
+// (default 1h) from now.
+func (s *SessionStore) refreshHandler(w http.ResponseWriter, r *http.Request) {
+	ttl, err := sessionTTL(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	session, err := s.Validate(r)
+	if err != nil {
+		writeSessionJSON(w, http.StatusUnauthorized, session, err)
+		return
+	}
+
+	// the old cookie stays valid until it expires, as concurrent requests
+	// may still carry it
+	refreshed := Session{ID: session.ID, Expires: time.Now().Add(ttl).UTC().Truncate(time.Second)}
+	s.refresh(session, refreshed)
+	session = refreshed
+	s.issue(w, r, session)
+	writeSessionJSON(w, http.StatusOK, session, nil)
+}
+
+// logoutHandler ends a valid session and deletes its cookie.
+func (s *SessionStore) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := s.Validate(r)
+	if err != nil {
+		writeSessionJSON(w, http.StatusUnauthorized, session, err)
+		return
+	}
+
+	s.revoke(session)
+	http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Path: "/", Expires: time.Unix(0, 0), MaxAge: -1})
+	writeSessionJSON(w, http.StatusOK, session, nil)
+}
+
+type jsonSession struct {
+	*Session
+	Error string `json:"error,omitempty"`
+}
+
+func writeSessionJSON(w http.ResponseWriter, status int, session Session, err error) {
+	data := jsonSession{}
+	if session.ID != "" {
+		data.Session = &session
+	}
+	if err != nil {
+		data.Error = err.Error()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	if err := e.Encode(data); err != nil {
+		logrus.Errorf("json marshal: %v", err)
+	}
+}
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stormforger/testapp/internal/randutil"
+)
+
+const (
+	defaultStallTimeout = time.Minute
+	maxStallTimeout     = 5 * time.Minute
+)
+
+// SlowResponseHandler sends its response slowly, depending on the `mode`
+// query parameter:
+//
+//   - body (default): sends the headers, then trickles `size` bytes of body,
+//     `chunk` bytes every `interval` milliseconds
+//   - headers: sends the status line and every header line `interval`
+//     milliseconds apart, including `headers` additional padding headers,
+//     followed by the body at once
+//   - stall: sends the status line and then nothing, until the client closes
+//     the connection or `timeout` seconds passed
+//
+// The headers and stall modes require HTTP/1.x.
+func SlowResponseHandler(w http.ResponseWriter, r *http.Request) {
+	size := intQueryParam(r, "size", 1024)
+	chunk := intQueryParam(r, "chunk", 1)
+	interval := time.Duration(intQueryParam(r, "interval", 100)) * time.Millisecond
+	if size < 0 || chunk < 1 || interval < 0 {
+		http.Error(w, "size, chunk and interval must be positive", http.StatusBadRequest)
+		return
+	}
+	// randutil's generator must not be used concurrently
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	switch mode := r.URL.Query().Get("mode"); mode {
+	case "", "body":
+		slowBody(w, r, rng, size, chunk, interval)
+	case "headers":
+		hijackSlow(w, func(conn net.Conn, bufrw *bufio.ReadWriter) {
+			slowHeaders(bufrw, rng, size, intQueryParam(r, "headers", 5), interval)
+		})
+	case "stall":
+		timeout := time.Duration(intQueryParam(r, "timeout", int(defaultStallTimeout/time.Second))) * time.Second
+		if timeout <= 0 || timeout > maxStallTimeout {
+			http.Error(w, fmt.Sprintf("timeout must be between 1 and %d seconds", maxStallTimeout/time.Second), http.StatusBadRequest)
+			return
+		}
+		hijackSlow(w, func(conn net.Conn, bufrw *bufio.ReadWriter) {
+			bufrw.WriteString("HTTP/1.1 200 OK\r\n")
+			bufrw.Flush()
+
+			// wait for the client to give up, or the timeout
+			if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+				logrus.Debugf("setting deadline: %v", err)
+			}
+			io.Copy(io.Discard, bufrw)
+		})
+	default:
+		http.Error(w, fmt.Sprintf("unknown mode %q", mode), http.StatusBadRequest)
+	}
+}
+
+// slowBody trickles the body. Via HTTP/1.x the connection is taken over, so
+// the write timeout of the server does not cut off the response. Via HTTP/2
+// the request is rejected if the body cannot be sent within the write
+// timeout.
+func slowBody(w http.ResponseWriter, r *http.Request, rng *rand.Rand, size, chunk int, interval time.Duration) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Content-Length", strconv.Itoa(size))
+
+	if _, ok := w.(http.Hijacker); ok && r.ProtoMajor == 1 {
+		header := w.Header().Clone()
+		header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+		header.Set("Connection", "close")
+		hijackSlow(w, func(conn net.Conn, bufrw *bufio.ReadWriter) {
+			bufrw.WriteString("HTTP/1.1 200 OK\r\n")
+			header.Write(bufrw)
+			bufrw.WriteString("\r\n")
+			if err := bufrw.Flush(); err != nil {
+				return
+			}
+			trickle(r.Context(), bufrw, bufrw.Flush, rng, size, chunk, interval)
+		})
+		return
+	}
+
+	if srv, ok := r.Context().Value(http.ServerContextKey).(*http.Server); ok && srv.WriteTimeout > 0 && size > 0 {
+		chunks := time.Duration((size + chunk - 1) / chunk)
+		if chunks*interval > srv.WriteTimeout*9/10 {
+			http.Error(w, fmt.Sprintf("sending %d chunks every %v does not fit the write timeout of %v", chunks, interval, srv.WriteTimeout), http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	flush := func() error { return nil }
+	if flusher, ok := w.(http.Flusher); ok {
+		flush = func() error {
+			flusher.Flush()
+			return nil
+		}
+	}
+	flush()
+	trickle(r.Context(), w, flush, rng, size, chunk, interval)
+}
+
+// trickle writes size random bytes to w, chunk bytes every interval.
+func trickle(ctx context.Context, w io.Writer, flush func() error, rng *rand.Rand, size, chunk int, interval time.Duration) {
+	for sent := 0; sent < size; sent += chunk {
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+
+		n := chunk
+		if sent+n > size {
+			n = size - sent
+		}
+		if _, err := w.Write(randomText(rng, n)); err != nil {
+			return
+		}
+		if err := flush(); err != nil {
+			return
+		}
+	}
+}
+
+func slowHeaders(bufrw *bufio.ReadWriter, rng *rand.Rand, size, headers int, interval time.Duration) {
+	lines := []string{
+		"HTTP/1.1 200 OK",
+		"Date: " + time.Now().UTC().Format(http.TimeFormat),
+		"Content-Type: text/plain",
+		"Content-Length: " + strconv.Itoa(size),
+		"Connection: close",
+	}
+	for i := 0; i < headers; i++ {
+		lines = append(lines, fmt.Sprintf("X-Slow-Header-%d: %s", i, randomText(rng, 16)))
+	}
+
+	for i, line := range lines {
+		if i > 0 {
+			time.Sleep(interval)
+		}
+		bufrw.WriteString(line + "\r\n")
+		if err := bufrw.Flush(); err != nil {
+			return
+		}
+	}
+
+	time.Sleep(interval)
+	bufrw.WriteString("\r\n")
+	bufrw.Write(randomText(rng, size))
+	bufrw.Flush()
+}
+
+// randomText returns n random alphanumeric characters.
+func randomText(rng *rand.Rand, n int) []byte {
+	const charset = randutil.Uppercase + randutil.Lowercase + randutil.Digits
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = charset[rng.Intn(len(charset))]
+	}
+	return b
+}
+
+// hijackSlow takes over the connection, clearing the deadlines of the server,
+// and closes it after fn returned.
+func hijackSlow(w http.ResponseWriter, fn func(conn net.Conn, bufrw *bufio.ReadWriter)) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "this mode requires HTTP/1.x", http.StatusBadRequest)
+		return
+	}
+	conn, bufrw, err := hj.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		logrus.Debugf("clearing deadline: %v", err)
+	}
+
+	fn(conn, bufrw)
+}
+
+// intQueryParam returns the query parameter name as int, or fallback if it is
+// missing or invalid.
+func intQueryParam(r *http.Request, name string, fallback int) int {
+	v, err := strconv.Atoi(r.URL.Query().Get(name))
+	if err != nil {
+		return fallback
+	}
+	return v
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type jsonUpload struct {
+	Bytes           int64   `json:"bytes"`
+	ReceivedBytes   int64   `json:"received_bytes"`
+	ContentEncoding string  `json:"content_encoding,omitempty"`
+	ContentType     string  `json:"content_type,omitempty"`
+	SHA256          string  `json:"sha256"`
+	DurationMillis  float64 `json:"duration_ms"`
+	BytesPerSecond  float64 `json:"bytes_per_second"`
+}
+
+// UploadHandler reads the request body without keeping it and responds with
+// its size, before and after decompression, its SHA-256 checksum and the
+// throughput as JSON.
+func UploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		w.Header().Set("Allow", "POST, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	start := time.Now()
+	hash := sha256.New()
+	n, err := io.Copy(hash, r.Body)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	duration := time.Since(start)
+
+	upload := jsonUpload{
+		Bytes:          n,
+		ReceivedBytes:  n,
+		ContentType:    r.Header.Get("Content-Type"),
+		SHA256:         hex.EncodeToString(hash.Sum(nil)),
+		DurationMillis: float64(duration.Microseconds()) / 1000,
+	}
+	if body := RequestBodyFromRequest(r); body != nil {
+		upload.ContentEncoding = body.ContentEncoding
+		upload.ReceivedBytes = body.Received()
+	}
+	if duration > 0 {
+		upload.BytesPerSecond = float64(upload.ReceivedBytes) / duration.Seconds()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	if err := e.Encode(upload); err != nil {
+		logrus.Errorf("json marshal: %v", err)
+	}
+}
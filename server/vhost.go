@@ -0,0 +1,99 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// VirtualHosts maps host names to the path prefixes served for them. Host
+// names may start with a "*." wildcard matching a single label, "*" matches
+// all hosts not configured otherwise. Requests for hosts without an entry
+// can use all routes.
+type VirtualHosts map[string][]string
+
+// ParseVirtualHosts parses a semicolon separated list of virtual hosts in the
+// form `host=/prefix,/prefix`, e.g.
+// `api.example.com=/demo,/respond-with;*.static.example.com=/data`.
+func ParseVirtualHosts(spec string) (VirtualHosts, error) {
+	vhosts := VirtualHosts{}
+
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		host, prefixes, found := strings.Cut(entry, "=")
+		host = strings.ToLower(strings.TrimSpace(host))
+		if !found || host == "" {
+			return nil, fmt.Errorf("invalid virtual host %q, expected host=/prefix,/prefix", entry)
+		}
+
+		for _, prefix := range strings.Split(prefixes, ",") {
+			prefix = strings.TrimSpace(prefix)
+			if prefix == "" {
+				continue
+			}
+			if !strings.HasPrefix(prefix, "/") {
+				return nil, fmt.Errorf("invalid path prefix %q for virtual host %s", prefix, host)
+			}
+			vhosts[host] = append(vhosts[host], prefix)
+		}
+
+		if len(vhosts[host]) == 0 {
+			return nil, fmt.Errorf("no path prefixes for virtual host %s", host)
+		}
+	}
+
+	return vhosts, nil
+}
+
+// prefixes returns the path prefixes of the virtual host matching host.
+func (v VirtualHosts) prefixes(host string) ([]string, bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	if prefixes, exists := v[host]; exists {
+		return prefixes, true
+	}
+	if i := strings.IndexByte(host, '.'); i > 0 {
+		if prefixes, exists := v["*"+host[i:]]; exists {
+			return prefixes, true
+		}
+	}
+	prefixes, exists := v["*"]
+	return prefixes, exists
+}
+
+// Middleware responds with 404 to requests for paths outside of the prefixes
+// configured for the requested host.
+func (v VirtualHosts) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prefixes, exists := v.prefixes(r.Host)
+		if !exists {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		for _, prefix := range prefixes {
+			if hasPathPrefix(r.URL.Path, prefix) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		http.NotFound(w, r)
+	})
+}
+
+// hasPathPrefix reports whether path is prefix or below it.
+func hasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
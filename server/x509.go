@@ -5,7 +5,6 @@ import (
 	"crypto/rand"
 	"crypto/x509"
 	"encoding/base64"
-	"encoding/json"
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
@@ -16,16 +15,8 @@ import (
 	"github.com/gorilla/mux"
 
 	"github.com/fullsailor/pkcs7"
-	"github.com/sirupsen/logrus"
 )
 
-type tlsInspect struct {
-	ServerName string `json:"server_name,omitempty"`
-	Status     string `json:"status,omitempty"`
-	Subject    string `json:"subject,omitempty"`
-	TLSversion string `json:"tls_version,omitempty"`
-}
-
 type x509Handlers struct {
 	CACertPEMData        []byte
 	CACertPKCS7DERBase64 []byte
@@ -33,20 +24,12 @@ type x509Handlers struct {
 	CAPrivateKey         interface{}
 }
 
-func RegisterX509ESTHandlers(router *mux.Router, serverCertificateFile, serverPrivateKeyFile string) error {
-	caCertPEMData, err := ioutil.ReadFile(serverCertificateFile)
-	if err != nil {
-		return err
-	}
-	caPrivateKeyPEMData, err := ioutil.ReadFile(serverPrivateKeyFile)
-	if err != nil {
-		return err
-	}
-
+func RegisterX509ESTHandlers(router *mux.Router, caCertPEMData, caPrivateKeyPEMData []byte) error {
 	x, err := buildX509Handlers(caCertPEMData, caPrivateKeyPEMData)
 	if err != nil {
 		return err
 	}
+	router.HandleFunc("/x509/ca.pem", x.caCertPEMHandler)
 	router.HandleFunc("/.well-known/est/cacerts", x.estCACertsHandler)
 	router.HandleFunc("/.well-known/est/simpleenroll", x.estEnrollHandler).Methods("POST")
 	router.HandleFunc("/.well-known/est/simplereenroll", x.estEnrollHandler).Methods("POST")
@@ -54,41 +37,6 @@ func RegisterX509ESTHandlers(router *mux.Router, serverCertificateFile, serverPr
 	return nil
 }
 
-func clientCertInspectHandler(w http.ResponseWriter, r *http.Request) {
-	if r.TLS == nil {
-		http.Error(w, "No TLS connection", http.StatusBadRequest)
-		return
-	}
-	certs := r.TLS.PeerCertificates
-
-	tlsInspection := &tlsInspect{
-		ServerName: r.TLS.ServerName,
-		TLSversion: fmt.Sprintf("1.%d", r.TLS.Version&0x0F-1),
-	}
-
-	if len(certs) == 0 {
-		tlsInspection.Status = "no_cert"
-
-		logrus.Warnf("x509inspect: No cert request from %v\n", r.RemoteAddr)
-	} else {
-		cert := certs[0]
-		tlsInspection.Subject = cert.Subject.String()
-		tlsInspection.Status = "client_cert"
-
-		logrus.Infof("x509inspect: Hello %s from %v\n", cert.Subject, r.RemoteAddr)
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-
-	e := json.NewEncoder(w)
-	e.SetIndent("", "  ")
-	err := e.Encode(tlsInspection)
-	if err != nil {
-		http.Error(w, "Cannot marshal TLS information.", http.StatusInternalServerError)
-		logrus.Errorf("json marshal: %v", err)
-	}
-}
-
 func (x *x509Handlers) estEnrollHandler(w http.ResponseWriter, r *http.Request) {
 	base64Decoder := base64.NewDecoder(base64.StdEncoding, r.Body)
 
@@ -136,6 +84,12 @@ func (x *x509Handlers) estEnrollHandler(w http.ResponseWriter, r *http.Request)
 	fmt.Fprint(w, base64.StdEncoding.EncodeToString(clientCRTRaw))
 }
 
+func (x *x509Handlers) caCertPEMHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-pem-file")
+
+	w.Write(x.CACertPEMData)
+}
+
 func (x *x509Handlers) estCACertsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/pkcs7-mime; smime-type=certs-only")
 	w.Header().Set("Content-Transfer-Encoding", "base64")
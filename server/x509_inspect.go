@@ -0,0 +1,178 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stormforger/testapp/internal/tlsutil"
+)
+
+type tlsInspect struct {
+	ServerName         string            `json:"server_name,omitempty"`
+	Status             string            `json:"status,omitempty"`
+	Subject            string            `json:"subject,omitempty"`
+	TLSversion         string            `json:"tls_version,omitempty"`
+	CipherSuite        string            `json:"cipher_suite,omitempty"`
+	NegotiatedProtocol string            `json:"negotiated_protocol,omitempty"`
+	DidResume          bool              `json:"did_resume"`
+	PeerCertificates   []certificateInfo `json:"peer_certificates,omitempty"`
+	PEM                string            `json:"pem,omitempty"`
+}
+
+type certificateInfo struct {
+	Subject           string    `json:"subject"`
+	Issuer            string    `json:"issuer"`
+	SerialNumber      string    `json:"serial_number"`
+	NotBefore         time.Time `json:"not_before"`
+	NotAfter          time.Time `json:"not_after"`
+	DNSNames          []string  `json:"dns_names,omitempty"`
+	IPAddresses       []string  `json:"ip_addresses,omitempty"`
+	EmailAddresses    []string  `json:"email_addresses,omitempty"`
+	URIs              []string  `json:"uris,omitempty"`
+	KeyType           string    `json:"key_type"`
+	KeySize           int       `json:"key_size,omitempty"`
+	IsCA              bool      `json:"is_ca"`
+	ExtKeyUsage       []string  `json:"ext_key_usage,omitempty"`
+	FingerprintSHA256 string    `json:"fingerprint_sha256"`
+}
+
+// extKeyUsageNames maps the extended key usages known to crypto/x509 to
+// their common names.
+var extKeyUsageNames = map[x509.ExtKeyUsage]string{
+	x509.ExtKeyUsageAny:                            "any",
+	x509.ExtKeyUsageServerAuth:                     "server_auth",
+	x509.ExtKeyUsageClientAuth:                     "client_auth",
+	x509.ExtKeyUsageCodeSigning:                    "code_signing",
+	x509.ExtKeyUsageEmailProtection:                "email_protection",
+	x509.ExtKeyUsageIPSECEndSystem:                 "ipsec_end_system",
+	x509.ExtKeyUsageIPSECTunnel:                    "ipsec_tunnel",
+	x509.ExtKeyUsageIPSECUser:                      "ipsec_user",
+	x509.ExtKeyUsageTimeStamping:                   "time_stamping",
+	x509.ExtKeyUsageOCSPSigning:                    "ocsp_signing",
+	x509.ExtKeyUsageMicrosoftServerGatedCrypto:     "microsoft_server_gated_crypto",
+	x509.ExtKeyUsageNetscapeServerGatedCrypto:      "netscape_server_gated_crypto",
+	x509.ExtKeyUsageMicrosoftCommercialCodeSigning: "microsoft_commercial_code_signing",
+	x509.ExtKeyUsageMicrosoftKernelCodeSigning:     "microsoft_kernel_code_signing",
+}
+
+// clientCertInspectHandler reports the negotiated TLS connection state and
+// the certificate chain presented by the client. Setting the `pem` query
+// parameter additionally exports the chain in PEM format.
+func clientCertInspectHandler(w http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil {
+		http.Error(w, "No TLS connection", http.StatusBadRequest)
+		return
+	}
+	certs := r.TLS.PeerCertificates
+
+	tlsInspection := &tlsInspect{
+		ServerName:         r.TLS.ServerName,
+		TLSversion:         tlsutil.VersionName(r.TLS.Version),
+		CipherSuite:        tlsutil.CipherSuiteName(r.TLS.CipherSuite),
+		NegotiatedProtocol: r.TLS.NegotiatedProtocol,
+		DidResume:          r.TLS.DidResume,
+	}
+
+	if len(certs) == 0 {
+		tlsInspection.Status = "no_cert"
+
+		logrus.Warnf("x509inspect: No cert request from %v\n", r.RemoteAddr)
+	} else {
+		cert := certs[0]
+		tlsInspection.Subject = cert.Subject.String()
+		tlsInspection.Status = "client_cert"
+
+		logrus.Infof("x509inspect: Hello %s from %v\n", cert.Subject, r.RemoteAddr)
+	}
+
+	for _, cert := range certs {
+		tlsInspection.PeerCertificates = append(tlsInspection.PeerCertificates, inspectCertificate(cert))
+	}
+
+	if r.URL.Query().Has("pem") {
+		var b strings.Builder
+		for _, cert := range certs {
+			pem.Encode(&b, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+		}
+		tlsInspection.PEM = b.String()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	err := e.Encode(tlsInspection)
+	if err != nil {
+		http.Error(w, "Cannot marshal TLS information.", http.StatusInternalServerError)
+		logrus.Errorf("json marshal: %v", err)
+	}
+}
+
+func inspectCertificate(cert *x509.Certificate) certificateInfo {
+	info := certificateInfo{
+		Subject:           cert.Subject.String(),
+		Issuer:            cert.Issuer.String(),
+		SerialNumber:      fmt.Sprintf("%X", cert.SerialNumber),
+		NotBefore:         cert.NotBefore,
+		NotAfter:          cert.NotAfter,
+		DNSNames:          cert.DNSNames,
+		EmailAddresses:    cert.EmailAddresses,
+		IsCA:              cert.IsCA,
+		FingerprintSHA256: fingerprint(cert.Raw),
+	}
+	info.KeyType, info.KeySize = publicKeyInfo(cert.PublicKey)
+
+	for _, ip := range cert.IPAddresses {
+		info.IPAddresses = append(info.IPAddresses, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		info.URIs = append(info.URIs, uri.String())
+	}
+	for _, eku := range cert.ExtKeyUsage {
+		if v, exists := extKeyUsageNames[eku]; exists {
+			info.ExtKeyUsage = append(info.ExtKeyUsage, v)
+		} else {
+			info.ExtKeyUsage = append(info.ExtKeyUsage, fmt.Sprintf("unknown_%d", eku))
+		}
+	}
+	for _, oid := range cert.UnknownExtKeyUsage {
+		info.ExtKeyUsage = append(info.ExtKeyUsage, oid.String())
+	}
+
+	return info
+}
+
+// publicKeyInfo returns the algorithm name and size in bits of a public key.
+func publicKeyInfo(pub interface{}) (string, int) {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return "RSA", k.N.BitLen()
+	case *ecdsa.PublicKey:
+		return "ECDSA", k.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		return "Ed25519", 256
+	default:
+		return fmt.Sprintf("%T", pub), 0
+	}
+}
+
+// fingerprint returns the colon separated SHA-256 hash of data, as printed by
+// `openssl x509 -fingerprint -sha256`.
+func fingerprint(data []byte) string {
+	sum := sha256.Sum256(data)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
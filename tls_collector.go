@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stormforger/testapp/internal/metrics"
+)
+
+const (
+	// tlsLogBufferSize is the number of handshakes buffered for logging
+	// before new ones are dropped.
+	tlsLogBufferSize = 1024
+	// tlsStatsMaxKeys limits the number of distinct values counted per
+	// statistic, further values are counted as "other".
+	tlsStatsMaxKeys = 1000
+)
+
+var (
+	tlsHandshakesTotal = metrics.NewCounterVec("testapp_tls_handshakes_total",
+		"Completed TLS handshakes by version and session resumption.", "version", "resumed")
+	tlsHandshakeDuration = metrics.NewHistogramVec("testapp_tls_handshake_duration_seconds",
+		"Duration of TLS handshakes from receiving the ClientHello, by certificate key type and session resumption.",
+		[]float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}, "key_type", "resumed")
+)
+
+// tlsCollector keeps the most recent TLS handshakes and aggregated counts of
+// all handshakes. Adding handshakes never blocks.
+type tlsCollector struct {
+	logCh chan tlsClientInfo
+
+	mu         sync.Mutex
+	recent     []tlsClientInfo
+	next       int
+	stats      tlsStats
+	droppedLog uint64
+}
+
+type tlsStats struct {
+	Handshakes    uint64            `json:"handshakes"`
+	Versions      map[string]uint64 `json:"versions"`
+	CipherSuites  map[string]uint64 `json:"cipher_suites"`
+	Curves        map[string]uint64 `json:"curves"`
+	ServerNames   map[string]uint64 `json:"server_names"`
+	ALPNProtocols map[string]uint64 `json:"alpn_protocols"`
+	JA4           map[string]uint64 `json:"ja4"`
+
+	FullHandshakes    uint64 `json:"full_handshakes"`
+	ResumedHandshakes uint64 `json:"resumed_handshakes"`
+	// HandshakeDurations are keyed by the certificate key type for full
+	// handshakes and "resumed" for resumed ones.
+	HandshakeDurations map[string]*tlsDurationStats `json:"handshake_durations"`
+}
+
+type tlsDurationStats struct {
+	Count     uint64  `json:"count"`
+	AvgMillis float64 `json:"avg_ms"`
+	MaxMillis float64 `json:"max_ms"`
+}
+
+func (d *tlsDurationStats) add(millis float64) {
+	d.Count++
+	d.AvgMillis += (millis - d.AvgMillis) / float64(d.Count)
+	if millis > d.MaxMillis {
+		d.MaxMillis = millis
+	}
+}
+
+func newTLSStats() tlsStats {
+	return tlsStats{
+		Versions:      map[string]uint64{},
+		CipherSuites:  map[string]uint64{},
+		Curves:        map[string]uint64{},
+		ServerNames:   map[string]uint64{},
+		ALPNProtocols: map[string]uint64{},
+		JA4:           map[string]uint64{},
+
+		HandshakeDurations: map[string]*tlsDurationStats{},
+	}
+}
+
+// newTLSCollector creates a collector keeping the last history handshakes.
+// If logging is enabled, every handshake is logged as JSON.
+func newTLSCollector(history int, logging bool) *tlsCollector {
+	c := &tlsCollector{
+		recent: make([]tlsClientInfo, 0, history),
+		stats:  newTLSStats(),
+	}
+
+	if logging {
+		c.logCh = make(chan tlsClientInfo, tlsLogBufferSize)
+		go func() {
+			for o := range c.logCh {
+				j, _ := json.Marshal(o)
+				logrus.Info(string(j))
+			}
+		}()
+	}
+
+	return c
+}
+
+func (c *tlsCollector) add(info tlsClientInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cap(c.recent) > 0 {
+		if len(c.recent) < cap(c.recent) {
+			c.recent = append(c.recent, info)
+		} else {
+			c.recent[c.next] = info
+		}
+		c.next = (c.next + 1) % cap(c.recent)
+	}
+
+	c.stats.Handshakes++
+	if n := info.Negotiated; n != nil {
+		count(c.stats.Versions, n.Version)
+		count(c.stats.CipherSuites, n.CipherSuite)
+		if n.Protocol != "" {
+			count(c.stats.ALPNProtocols, n.Protocol)
+		}
+
+		durationKey, keyTypeLabel := n.KeyType, n.KeyType
+		if n.DidResume {
+			c.stats.ResumedHandshakes++
+			durationKey = "resumed"
+		} else {
+			c.stats.FullHandshakes++
+		}
+		if keyTypeLabel == "" {
+			keyTypeLabel = "none"
+		}
+
+		resumed := strconv.FormatBool(n.DidResume)
+		tlsHandshakesTotal.Inc(n.Version, resumed)
+		if n.HandshakeMillis > 0 {
+			tlsHandshakeDuration.Observe(n.HandshakeMillis/1000, keyTypeLabel, resumed)
+
+			d, exists := c.stats.HandshakeDurations[durationKey]
+			if !exists && len(c.stats.HandshakeDurations) < tlsStatsMaxKeys {
+				d = &tlsDurationStats{}
+				c.stats.HandshakeDurations[durationKey] = d
+			}
+			if d != nil {
+				d.add(n.HandshakeMillis)
+			}
+		}
+	}
+	for _, curve := range info.SupportedCurves {
+		count(c.stats.Curves, curve)
+	}
+	if info.RequestedServerName != "" {
+		count(c.stats.ServerNames, info.RequestedServerName)
+	} else {
+		count(c.stats.ServerNames, "(none)")
+	}
+	if info.JA4 != "" {
+		count(c.stats.JA4, info.JA4)
+	}
+
+	if c.logCh != nil {
+		select {
+		case c.logCh <- info:
+		default:
+			c.droppedLog++
+		}
+	}
+}
+
+func count(m map[string]uint64, key string) {
+	if _, exists := m[key]; !exists && len(m) >= tlsStatsMaxKeys {
+		key = "other"
+	}
+	m[key]++
+}
+
+// clientsHandler responds with the most recent handshakes, newest first.
+// The `limit` query parameter restricts the number of entries.
+func (c *tlsCollector) clientsHandler(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	clients := make([]tlsClientInfo, 0, len(c.recent))
+	for i := 1; i <= len(c.recent); i++ {
+		clients = append(clients, c.recent[(c.next-i+len(c.recent))%len(c.recent)])
+	}
+	c.mu.Unlock()
+
+	if limit, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && limit >= 0 && limit < len(clients) {
+		clients = clients[:limit]
+	}
+
+	writeJSON(w, clients)
+}
+
+// statsHandler responds with the aggregated handshake counts. A DELETE
+// request resets them.
+func (c *tlsCollector) statsHandler(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	if r.Method == http.MethodDelete {
+		c.stats = newTLSStats()
+		c.droppedLog = 0
+	}
+	stats := struct {
+		tlsStats
+		DroppedLogMessages uint64 `json:"dropped_log_messages"`
+	}{c.stats, c.droppedLog}
+	j, err := json.MarshalIndent(stats, "", "  ")
+	c.mu.Unlock()
+
+	if err != nil {
+		http.Error(w, "Cannot marshal TLS stats.", http.StatusInternalServerError)
+		logrus.Errorf("json marshal: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	if err := e.Encode(v); err != nil {
+		logrus.Errorf("json marshal: %v", err)
+	}
+}
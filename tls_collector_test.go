@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stormforger/testapp/internal/pki"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLSCollector(t *testing.T) {
+	c := newTLSCollector(2, false)
+	for _, name := range []string{"a.test", "b.test", "c.test"} {
+		c.add(tlsClientInfo{
+			RequestedServerName: name,
+			Negotiated:          &tlsNegotiated{Version: "TLS 1.3", KeyType: pki.KeyTypeECDSA, HandshakeMillis: 2},
+		})
+	}
+	c.add(tlsClientInfo{Negotiated: &tlsNegotiated{Version: "TLS 1.2", DidResume: true, HandshakeMillis: 1}})
+
+	clients := func(query string) []string {
+		w := httptest.NewRecorder()
+		c.clientsHandler(w, httptest.NewRequest(http.MethodGet, "/tls/clients"+query, nil))
+		var infos []tlsClientInfo
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &infos))
+		var names []string
+		for _, info := range infos {
+			names = append(names, info.RequestedServerName)
+		}
+		return names
+	}
+	// the oldest handshakes are evicted, the newest comes first
+	assert.Equal(t, []string{"", "c.test"}, clients(""))
+	assert.Equal(t, []string{""}, clients("?limit=1"))
+
+	var stats struct {
+		Handshakes         uint64            `json:"handshakes"`
+		Versions           map[string]uint64 `json:"versions"`
+		ServerNames        map[string]uint64 `json:"server_names"`
+		FullHandshakes     uint64            `json:"full_handshakes"`
+		ResumedHandshakes  uint64            `json:"resumed_handshakes"`
+		HandshakeDurations map[string]struct {
+			Count     uint64  `json:"count"`
+			AvgMillis float64 `json:"avg_ms"`
+		} `json:"handshake_durations"`
+	}
+	w := httptest.NewRecorder()
+	c.statsHandler(w, httptest.NewRequest(http.MethodGet, "/tls/stats", nil))
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &stats))
+	assert.Equal(t, uint64(4), stats.Handshakes)
+	assert.Equal(t, map[string]uint64{"TLS 1.3": 3, "TLS 1.2": 1}, stats.Versions)
+	assert.Equal(t, uint64(1), stats.ServerNames["(none)"])
+	assert.Equal(t, uint64(3), stats.FullHandshakes)
+	assert.Equal(t, uint64(1), stats.ResumedHandshakes)
+	assert.Equal(t, uint64(3), stats.HandshakeDurations[pki.KeyTypeECDSA].Count)
+	assert.Equal(t, 2.0, stats.HandshakeDurations[pki.KeyTypeECDSA].AvgMillis)
+	assert.Equal(t, uint64(1), stats.HandshakeDurations["resumed"].Count)
+
+	w = httptest.NewRecorder()
+	c.statsHandler(w, httptest.NewRequest(http.MethodDelete, "/tls/stats", nil))
+	var reset struct {
+		Handshakes uint64            `json:"handshakes"`
+		Versions   map[string]uint64 `json:"versions"`
+	}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &reset))
+	assert.Equal(t, uint64(0), reset.Handshakes)
+	assert.Empty(t, reset.Versions)
+}
+
+func TestTLSCollectorWithoutHistory(t *testing.T) {
+	c := newTLSCollector(0, false)
+	c.add(tlsClientInfo{RequestedServerName: "a.test"})
+
+	w := httptest.NewRecorder()
+	c.clientsHandler(w, httptest.NewRequest(http.MethodGet, "/tls/clients", nil))
+	assert.Equal(t, "[]\n", w.Body.String())
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stormforger/testapp/internal/tlsutil"
+)
+
+// sessionTicketKeysKept is the number of session ticket keys accepted when
+// rotating keys, so tickets stay valid for up to that many rotation intervals.
+const sessionTicketKeysKept = 2
+
+// tlsSettings are the protocol parameters of the HTTPS server. Zero values
+// keep the defaults of crypto/tls.
+type tlsSettings struct {
+	MinVersion            uint16
+	MaxVersion            uint16
+	CipherSuites          []uint16
+	Curves                []tls.CurveID
+	ALPN                  []string
+	SessionTickets        bool
+	SessionTicketRotation time.Duration
+}
+
+func tlsSettingsFromENV() (tlsSettings, error) {
+	settings := tlsSettings{
+		ALPN:           splitList(getEnv("TLS_ALPN", "h2,http/1.1")),
+		SessionTickets: getEnv("TLS_SESSION_TICKETS", "true") == "true",
+	}
+
+	var err error
+	if settings.MinVersion, err = versionFromENV("TLS_MIN_VERSION"); err != nil {
+		return settings, err
+	}
+	if settings.MaxVersion, err = versionFromENV("TLS_MAX_VERSION"); err != nil {
+		return settings, err
+	}
+	if settings.MinVersion != 0 && settings.MaxVersion != 0 && settings.MinVersion > settings.MaxVersion {
+		return settings, fmt.Errorf("TLS_MIN_VERSION %s is above TLS_MAX_VERSION %s",
+			tlsutil.VersionName(settings.MinVersion), tlsutil.VersionName(settings.MaxVersion))
+	}
+
+	// the cipher suites have to be usable with one of the enabled versions
+	// below TLS 1.3, whose cipher suites are not configurable
+	minVersion, maxVersion := settings.MinVersion, settings.MaxVersion
+	if minVersion == 0 {
+		minVersion = tls.VersionTLS10
+	}
+	if maxVersion == 0 {
+		maxVersion = tls.VersionTLS13
+	}
+	implemented := map[uint16]*tls.CipherSuite{}
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		implemented[suite.ID] = suite
+	}
+	for _, name := range splitList(getEnv("TLS_CIPHER_SUITES", "")) {
+		id, err := tlsutil.ParseCipherSuite(name)
+		if err != nil {
+			return settings, fmt.Errorf("TLS_CIPHER_SUITES: %w", err)
+		}
+		suite, ok := implemented[id]
+		if !ok {
+			return settings, fmt.Errorf("TLS_CIPHER_SUITES: cipher suite %s is not supported", name)
+		}
+		usable := false
+		for _, v := range suite.SupportedVersions {
+			if v == tls.VersionTLS13 {
+				return settings, fmt.Errorf("TLS_CIPHER_SUITES: TLS 1.3 cipher suite %s cannot be configured", name)
+			}
+			usable = usable || (v >= minVersion && v <= maxVersion)
+		}
+		if !usable {
+			return settings, fmt.Errorf("TLS_CIPHER_SUITES: cipher suite %s cannot be used with %s to %s",
+				name, tlsutil.VersionName(minVersion), tlsutil.VersionName(maxVersion))
+		}
+		settings.CipherSuites = append(settings.CipherSuites, id)
+	}
+
+	for _, name := range splitList(getEnv("TLS_CURVES", "")) {
+		curve, err := tlsutil.ParseCurve(name)
+		if err != nil {
+			return settings, fmt.Errorf("TLS_CURVES: %w", err)
+		}
+		settings.Curves = append(settings.Curves, curve)
+	}
+
+	if settings.SessionTicketRotation, err = time.ParseDuration(getEnv("TLS_SESSION_TICKET_ROTATION", "0s")); err != nil {
+		return settings, fmt.Errorf("TLS_SESSION_TICKET_ROTATION: %w", err)
+	}
+
+	return settings, nil
+}
+
+// versionFromENV parses the TLS version in the environment variable name, 0
+// if it is empty.
+func versionFromENV(name string) (uint16, error) {
+	v := getEnv(name, "")
+	if v == "" {
+		return 0, nil
+	}
+	version, err := tlsutil.ParseVersion(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", name, err)
+	}
+	if version < tls.VersionTLS10 || version > tls.VersionTLS13 {
+		return 0, fmt.Errorf("%s: %s is not supported", name, tlsutil.VersionName(version))
+	}
+	return version, nil
+}
+
+// apply configures the TLS config of server. HTTP/2 is only offered if h2 is
+// part of the ALPN list.
+func (s tlsSettings) apply(server *http.Server) {
+	c := server.TLSConfig
+	c.MinVersion = s.MinVersion
+	c.MaxVersion = s.MaxVersion
+	c.CipherSuites = s.CipherSuites
+	c.CurvePreferences = s.Curves
+	c.NextProtos = s.ALPN
+	c.SessionTicketsDisabled = !s.SessionTickets
+
+	if !stringsContain(s.ALPN, "h2") {
+		// a non-nil map keeps net/http from enabling HTTP/2
+		server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+}
+
+// rotateSessionTicketKeys replaces the session ticket keys of c every
+// interval until ctx is done.
+func rotateSessionTicketKeys(ctx context.Context, c *tls.Config, interval time.Duration) error {
+	var keys [][32]byte
+
+	rotate := func() error {
+		var key [32]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+
+		keys = append([][32]byte{key}, keys...)
+		if len(keys) > sessionTicketKeysKept {
+			keys = keys[:sessionTicketKeysKept]
+		}
+		c.SetSessionTicketKeys(keys)
+		return nil
+	}
+
+	if err := rotate(); err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := rotate(); err != nil {
+					logrus.WithError(err).Error("rotating session ticket keys failed")
+					continue
+				}
+				logrus.Debug("Rotated session ticket keys")
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func stringsContain(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
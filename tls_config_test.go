@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/tls"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLSSettingsFromENV(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		env      map[string]string
+		expected tlsSettings
+		err      string
+	}{
+		{
+			name:     "defaults",
+			expected: tlsSettings{ALPN: []string{"h2", "http/1.1"}, SessionTickets: true},
+		},
+		{
+			name: "all set",
+			env: map[string]string{
+				"TLS_MIN_VERSION":             "1.2",
+				"TLS_MAX_VERSION":             "TLS 1.3",
+				"TLS_CIPHER_SUITES":           "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls_ecdhe_rsa_with_aes_128_gcm_sha256",
+				"TLS_CURVES":                  "x25519,P-256",
+				"TLS_ALPN":                    "http/1.1",
+				"TLS_SESSION_TICKETS":         "false",
+				"TLS_SESSION_TICKET_ROTATION": "1h",
+			},
+			expected: tlsSettings{
+				MinVersion:            tls.VersionTLS12,
+				MaxVersion:            tls.VersionTLS13,
+				CipherSuites:          []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+				Curves:                []tls.CurveID{tls.X25519, tls.CurveP256},
+				ALPN:                  []string{"http/1.1"},
+				SessionTicketRotation: time.Hour,
+			},
+		},
+		{name: "unknown version", env: map[string]string{"TLS_MIN_VERSION": "1.4"}, err: `TLS_MIN_VERSION: unknown TLS version "1.4"`},
+		{name: "SSL 3.0", env: map[string]string{"TLS_MIN_VERSION": "SSL 3.0"}, err: "TLS_MIN_VERSION: SSL 3.0 is not supported"},
+		{name: "min above max", env: map[string]string{"TLS_MIN_VERSION": "1.3", "TLS_MAX_VERSION": "1.2"}, err: "TLS_MIN_VERSION TLS 1.3 is above TLS_MAX_VERSION TLS 1.2"},
+		{name: "unknown cipher suite", env: map[string]string{"TLS_CIPHER_SUITES": "TLS_NOPE"}, err: `TLS_CIPHER_SUITES: unknown cipher suite "TLS_NOPE"`},
+		{name: "unimplemented cipher suite", env: map[string]string{"TLS_CIPHER_SUITES": "TLS_DHE_RSA_WITH_AES_128_GCM_SHA256"}, err: "is not supported"},
+		{name: "TLS 1.3 cipher suite", env: map[string]string{"TLS_CIPHER_SUITES": "TLS_AES_128_GCM_SHA256"}, err: "TLS 1.3 cipher suite TLS_AES_128_GCM_SHA256 cannot be configured"},
+		{
+			name: "cipher suite with TLS 1.3 only",
+			env:  map[string]string{"TLS_MIN_VERSION": "1.3", "TLS_CIPHER_SUITES": "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+			err:  "cannot be used with TLS 1.3 to TLS 1.3",
+		},
+		{
+			name: "TLS 1.2 cipher suite with TLS 1.0",
+			env:  map[string]string{"TLS_MAX_VERSION": "1.0", "TLS_CIPHER_SUITES": "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+			err:  "cannot be used with TLS 1.0 to TLS 1.0",
+		},
+		{name: "unknown curve", env: map[string]string{"TLS_CURVES": "P-192"}, err: `TLS_CURVES: unknown curve "P-192"`},
+		{name: "invalid rotation", env: map[string]string{"TLS_SESSION_TICKET_ROTATION": "daily"}, err: "TLS_SESSION_TICKET_ROTATION"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, name := range []string{"TLS_MIN_VERSION", "TLS_MAX_VERSION", "TLS_CIPHER_SUITES", "TLS_CURVES", "TLS_ALPN", "TLS_SESSION_TICKETS", "TLS_SESSION_TICKET_ROTATION"} {
+				// restored after the test
+				t.Setenv(name, "")
+				if v, ok := tc.env[name]; ok {
+					os.Setenv(name, v)
+				} else {
+					os.Unsetenv(name)
+				}
+			}
+
+			settings, err := tlsSettingsFromENV()
+			if tc.err != "" {
+				require.NotNil(t, err)
+				assert.Contains(t, err.Error(), tc.err)
+				return
+			}
+			require.Nil(t, err)
+			assert.Equal(t, tc.expected, settings)
+		})
+	}
+}
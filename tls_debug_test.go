@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewTLSClientInfo(t *testing.T) {
+	conn, other := net.Pipe()
+	defer conn.Close()
+	defer other.Close()
+
+	info := newTLSClientInfo(&tls.ClientHelloInfo{
+		Conn:              conn,
+		ServerName:        "example.com",
+		SupportedVersions: []uint16{0x0a0a, tls.VersionTLS13, tls.VersionTLS12},
+		CipherSuites:      []uint16{0x1a1a, tls.TLS_AES_128_GCM_SHA256},
+		SupportedCurves:   []tls.CurveID{0x2a2a, tls.X25519},
+		SupportedPoints:   []uint8{0},
+		SignatureSchemes:  []tls.SignatureScheme{0x3a3a, tls.ECDSAWithP256AndSHA256},
+		SupportedProtos:   []string{"\x4a\x4a", "h2", "http/1.1"},
+	})
+
+	assert.True(t, info.SNI)
+	assert.Equal(t, "example.com", info.RequestedServerName)
+	assert.Equal(t, "pipe", info.Remote)
+	assert.True(t, info.Grease)
+	assert.Equal(t, []string{"TLS 1.3", "TLS 1.2"}, info.SupportedVersions)
+	assert.Equal(t, []string{"TLS_AES_128_GCM_SHA256"}, info.SupportedSuites)
+	assert.Equal(t, []string{"x25519"}, info.SupportedCurves)
+	assert.Equal(t, []string{"0x0"}, info.SupportedPoints)
+	assert.Equal(t, []string{"ecdsa_secp256r1_sha256"}, info.SignatureSchemes)
+	assert.Equal(t, []string{"h2", "http/1.1"}, info.ALPNProtocols)
+
+	info = newTLSClientInfo(&tls.ClientHelloInfo{Conn: conn, SupportedVersions: []uint16{tls.VersionTLS12}})
+	assert.False(t, info.SNI)
+	assert.False(t, info.Grease)
+}